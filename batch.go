@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const batchSeparator = "----"
+
+func runBatch(ctx context.Context, session *ChatSession, r io.Reader, delimiter string) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	defer session.shutdown()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read prompts from stdin: %w", err)
+	}
+
+	prompts := splitRecords(strings.ReplaceAll(string(data), "\r\n", "\n"), delimiter)
+	base := session.conversation.snapshot()
+	for i, prompt := range prompts {
+		if i > 0 {
+			fmt.Fprintf(session.out, "%s%s%s\n", colorDim, batchSeparator, colorReset)
+		}
+
+		if !session.withinCostLimit(ctx) {
+			return errors.New("session cost limit reached")
+		}
+		session.conversation.replaceWith(base.snapshot())
+		session.conversation.addMessage("user", prompt)
+		if err := session.respond(ctx); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func splitRecords(data, delimiter string) []string {
+	var records []string
+	for _, record := range strings.Split(data, delimiter) {
+		if record = strings.TrimSpace(record); record != "" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
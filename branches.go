@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var branchNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func handleBranchCommand(userInput string, session *ChatSession) error {
+	parts := strings.Fields(userInput)
+	if len(parts) != 2 {
+		fmt.Fprintf(session.out, "%sUsage: /branch <name>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	name := parts[1]
+	if !branchNamePattern.MatchString(name) {
+		fmt.Fprintf(session.out, "%sBranch names may only contain letters, digits, '-' and '_'.%s\n", colorRed, colorReset)
+		return nil
+	}
+
+	if _, exists := session.branches[name]; exists || name == session.currentBranch {
+		fmt.Fprintf(session.out, "%sBranch %q already exists.%s\n", colorRed, name, colorReset)
+		return nil
+	}
+
+	session.branches[name] = session.conversation.snapshot()
+	fmt.Fprintf(session.out, "%sCreated branch %q from %q.%s\n", colorGreen, name, session.currentBranch, colorReset)
+	return nil
+}
+
+func handleSwitchCommand(userInput string, session *ChatSession) error {
+	parts := strings.Fields(userInput)
+	if len(parts) != 2 {
+		fmt.Fprintf(session.out, "%sUsage: /switch <name>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	name := parts[1]
+	if name == session.currentBranch {
+		fmt.Fprintf(session.out, "%sAlready on branch %q.%s\n", colorYellow, name, colorReset)
+		return nil
+	}
+
+	target, ok := session.branches[name]
+	if !ok {
+		fmt.Fprintf(session.out, "%sUnknown branch %q.%s\n", colorRed, name, colorReset)
+		return nil
+	}
+
+	session.branches[session.currentBranch] = session.conversation.snapshot()
+	session.conversation.replaceWith(target)
+	delete(session.branches, name)
+	session.currentBranch = name
+
+	fmt.Fprintf(session.out, "%sSwitched to branch %q.%s\n", colorGreen, name, colorReset)
+	printConversationSummary(session.out, session.conversation, session.apiClient.config)
+	return nil
+}
+
+func handleBranchesCommand(session *ChatSession) error {
+	branches := session.allBranches()
+	names := make([]string, 0, len(branches))
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(session.out, "%sBranches:%s\n", colorCyan, colorReset)
+	for _, name := range names {
+		marker := " "
+		if name == session.currentBranch {
+			marker = "*"
+		}
+		branch := branches[name]
+		fmt.Fprintf(session.out, "%s %s (%d messages, %d tokens)\n", marker, name, len(branch.History), branch.tokenCount)
+	}
+	return nil
+}
+
+func handleSaveAllBranches(session *ChatSession) error {
+	timestamp := time.Now().Format("20060102_150405")
+	saved := true
+	for name, branch := range session.allBranches() {
+		if err := session.store.Save(fmt.Sprintf("conversation_%s_%s", timestamp, name), branch); err != nil {
+			fmt.Fprintf(session.out, "%sError saving branch %q: %v%s\n", colorRed, name, err, colorReset)
+			saved = false
+		}
+	}
+	if saved {
+		session.conversation.markSaved()
+	}
+	return nil
+}
+
+func (s *ChatSession) allBranches() map[string]*Conversation {
+	branches := make(map[string]*Conversation, len(s.branches)+1)
+	for name, branch := range s.branches {
+		branches[name] = branch
+	}
+	branches[s.currentBranch] = s.conversation.snapshot()
+	return branches
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const maxCompareConcurrency = 3
+
+func handleCompareCommand(ctx context.Context, userInput string, session *ChatSession) error {
+	prompt := strings.TrimSpace(strings.TrimPrefix(userInput, "/compare"))
+	if prompt == "" {
+		fmt.Fprintf(session.out, "%sUsage: /compare <prompt>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	models := session.apiClient.config.CompareModels
+	if len(models) == 0 {
+		fmt.Fprintf(session.out, "%sNo compare_models configured.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	if !session.withinCostLimit(ctx) {
+		return nil
+	}
+
+	responses := make([]AIResponse, len(models))
+	errs := make([]error, len(models))
+
+	spinner := startSpinner(session, session.apiClient.config.ThinkingText)
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(maxCompareConcurrency)
+	for i, model := range models {
+		g.Go(func() error {
+			conversation := session.conversation.snapshot()
+			conversation.addMessage("user", prompt)
+			responses[i], errs[i] = getAIResponseFromModel(groupCtx, session.apiClient, conversation, model, maxRetries, nil)
+			return nil
+		})
+	}
+	g.Wait()
+	spinner.Stop()
+
+	for i, model := range models {
+		fmt.Fprintf(session.out, "%s== %s ==%s\n", colorCyan, model, colorReset)
+		if errs[i] != nil {
+			fmt.Fprintf(session.out, "%sError: %v%s\n", colorRed, errs[i], colorReset)
+		} else {
+			fmt.Fprintln(session.out, session.apiClient.withPrefill(responses[i].Content))
+		}
+		session.endTurn()
+	}
+	return nil
+}
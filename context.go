@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func loadContextFiles(conversation *Conversation, patterns []string, budget int) error {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			fmt.Printf("%sNo files match %q.%s\n", colorYellow, pattern, colorReset)
+		}
+		files = append(files, matches...)
+	}
+
+	var content strings.Builder
+	used, loaded := 0, 0
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("%sSkipping %s: %v%s\n", colorYellow, file, err, colorReset)
+			continue
+		}
+
+		block := fmt.Sprintf("File: %s\n```\n%s\n```\n\n", file, strings.TrimRight(string(data), "\n"))
+		if used+len(block) > budget {
+			fmt.Printf("%sSkipping %s: exceeds the context budget of %d bytes.%s\n", colorYellow, file, budget, colorReset)
+			continue
+		}
+
+		content.WriteString(block)
+		used += len(block)
+		loaded++
+	}
+
+	if loaded == 0 {
+		return nil
+	}
+
+	conversation.addMessage("user", "The following files are provided as context:\n\n"+strings.TrimSpace(content.String()))
+	fmt.Printf("%sLoaded %d file(s) into context (%d bytes).%s\n", colorGreen, loaded, used, colorReset)
+	return nil
+}
+
+func loadExamples(path string) ([]Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read examples file: %w", err)
+	}
+
+	var examples []Message
+	if err := json.Unmarshal(data, &examples); err != nil {
+		return nil, fmt.Errorf("failed to parse examples file: %w", err)
+	}
+
+	for i, example := range examples {
+		if example.Role != "user" && example.Role != "assistant" {
+			return nil, fmt.Errorf("example %d has role %q, expected user or assistant", i+1, example.Role)
+		}
+		if strings.TrimSpace(example.Content) == "" {
+			return nil, fmt.Errorf("example %d has no content", i+1)
+		}
+	}
+	return examples, nil
+}
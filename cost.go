@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type UsageTracker struct {
+	mu     sync.Mutex
+	totals map[string]*UsageTotals
+}
+
+type UsageTotals struct {
+	PromptTokens     int
+	CompletionTokens int
+	Approximate      bool
+}
+
+func (t *UsageTracker) record(model string, usage *Usage, estimatedPrompt, estimatedCompletion int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.totals == nil {
+		t.totals = make(map[string]*UsageTotals)
+	}
+	totals, ok := t.totals[model]
+	if !ok {
+		totals = &UsageTotals{}
+		t.totals[model] = totals
+	}
+
+	if usage == nil {
+		totals.PromptTokens += estimatedPrompt
+		totals.CompletionTokens += estimatedCompletion
+		totals.Approximate = true
+		return
+	}
+	totals.PromptTokens += usage.PromptTokens
+	totals.CompletionTokens += usage.CompletionTokens
+}
+
+func (t *UsageTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.totals = nil
+}
+
+func (t *UsageTracker) snapshot() map[string]UsageTotals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]UsageTotals, len(t.totals))
+	for model, totals := range t.totals {
+		snapshot[model] = *totals
+	}
+	return snapshot
+}
+
+func (p ModelPricing) cost(totals UsageTotals) float64 {
+	return float64(totals.PromptTokens)/1e6*p.InputPerMillion + float64(totals.CompletionTokens)/1e6*p.OutputPerMillion
+}
+
+func (c *APIClient) sessionCost() float64 {
+	var total float64
+	for model, usage := range c.usage.snapshot() {
+		if pricing, ok := c.config.Pricing[model]; ok {
+			total += pricing.cost(usage)
+		}
+	}
+	return total
+}
+
+func (s *ChatSession) withinCostLimit(ctx context.Context) bool {
+	limit := s.apiClient.config.MaxSessionCost
+	if limit <= 0 {
+		return true
+	}
+	spent := s.apiClient.sessionCost()
+	if spent < limit {
+		return true
+	}
+
+	fmt.Fprintf(s.out, "%sSession cost $%.4f has reached the limit of $%.4f; request not sent.%s\n", colorRed, spent, limit, colorReset)
+	if s.input == nil || !s.terminal.Interactive {
+		return false
+	}
+
+	fmt.Fprintf(s.out, "%sRaise the limit to (Enter to keep $%.4f):%s ", colorYellow, limit, colorReset)
+	answer, err := s.input.readLine(ctx, 0)
+	if err != nil || answer == "" {
+		return false
+	}
+	raised, err := strconv.ParseFloat(strings.TrimPrefix(answer, "$"), 64)
+	if err != nil || raised <= spent {
+		fmt.Fprintf(s.out, "%sThe new limit must be a number above $%.4f.%s\n", colorRed, spent, colorReset)
+		return false
+	}
+	s.apiClient.config.MaxSessionCost = raised
+	fmt.Fprintf(s.out, "%sSession cost limit raised to $%.4f.%s\n", colorGreen, raised, colorReset)
+	return true
+}
+
+func handleCostCommand(session *ChatSession) error {
+	apiClient := session.apiClient
+	totals := apiClient.usage.snapshot()
+	if len(totals) == 0 {
+		fmt.Fprintf(session.out, "%sNo requests made yet.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	models := make([]string, 0, len(totals))
+	for model := range totals {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	var total float64
+	approximate := false
+	fmt.Fprintf(session.out, "%sSession cost estimate:%s\n", colorCyan, colorReset)
+	for _, model := range models {
+		usage := totals[model]
+		approximate = approximate || usage.Approximate
+		pricing, ok := apiClient.config.Pricing[model]
+		if !ok {
+			fmt.Fprintf(session.out, "  %s: %d prompt + %d completion tokens (no pricing configured)\n", model, usage.PromptTokens, usage.CompletionTokens)
+			continue
+		}
+		cost := pricing.cost(usage)
+		total += cost
+		fmt.Fprintf(session.out, "  %s: %d prompt + %d completion tokens = $%.4f\n", model, usage.PromptTokens, usage.CompletionTokens, cost)
+	}
+
+	fmt.Fprintf(session.out, "Total: $%.4f\n", total)
+	if limit := apiClient.config.MaxSessionCost; limit > 0 {
+		fmt.Fprintf(session.out, "Limit: $%.4f\n", limit)
+	}
+	if approximate {
+		fmt.Fprintf(session.out, "%sApproximate: some responses did not report usage, so token counts were estimated.%s\n", colorYellow, colorReset)
+	}
+	return nil
+}
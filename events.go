@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventSink interface {
+	OnRequest(model string, attempt int)
+	OnResponse(model string, latency time.Duration, usage *Usage)
+	OnError(model string, err error)
+}
+
+type NoopEventSink struct{}
+
+func (NoopEventSink) OnRequest(string, int)                    {}
+func (NoopEventSink) OnResponse(string, time.Duration, *Usage) {}
+func (NoopEventSink) OnError(string, error)                    {}
+
+type JSONLinesEventSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type eventRecord struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Model     string    `json:"model"`
+	Attempt   int       `json:"attempt,omitempty"`
+	LatencyMS int64     `json:"latency_ms,omitempty"`
+	Usage     *Usage    `json:"usage,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newJSONLinesEventSink(path string) (*JSONLinesEventSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &JSONLinesEventSink{file: file}, nil
+}
+
+func (s *JSONLinesEventSink) OnRequest(model string, attempt int) {
+	s.write(eventRecord{Event: "request", Model: model, Attempt: attempt})
+}
+
+func (s *JSONLinesEventSink) OnResponse(model string, latency time.Duration, usage *Usage) {
+	s.write(eventRecord{Event: "response", Model: model, LatencyMS: latency.Milliseconds(), Usage: usage})
+}
+
+func (s *JSONLinesEventSink) OnError(model string, err error) {
+	s.write(eventRecord{Event: "error", Model: model, Error: err.Error()})
+}
+
+func (s *JSONLinesEventSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func (s *JSONLinesEventSink) write(record eventRecord) {
+	record.Time = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file.Write(append(data, '\n'))
+}
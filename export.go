@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+const htmlPageStyle = `body{font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;max-width:860px;margin:2em auto;padding:0 1em;color:#1f2328;line-height:1.5}
+h1{border-bottom:1px solid #d0d7de;padding-bottom:.3em}
+section{border:1px solid #d0d7de;border-radius:6px;margin:1em 0;padding:.5em 1em}
+section.user{background:#f6f8fa}
+section.system{background:#fff8c5}
+h2{font-size:1em;margin:.3em 0;color:#57606a;text-transform:uppercase;letter-spacing:.05em}
+pre{padding:.8em;border-radius:6px;overflow-x:auto;background:#f6f8fa}
+`
+
+func handleSaveMarkdownCommand(userInput string, session *ChatSession) error {
+	config := session.apiClient.config
+	target := strings.TrimSpace(strings.TrimPrefix(userInput, "/save-md"))
+	switch {
+	case target == "":
+		target = filepath.Join(config.SessionsDir, fmt.Sprintf("conversation_%s.md", time.Now().Format("20060102_150405")))
+	case !filepath.IsAbs(target):
+		target = filepath.Join(config.SessionsDir, target)
+	}
+
+	if err := saveMarkdown(session.out, session.conversation, target, config); err != nil {
+		fmt.Fprintf(session.out, "%sError exporting conversation: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+
+	if config.OpenExports {
+		if err := openFile(target); err != nil {
+			fmt.Fprintf(session.out, "%sCould not open %s: %v%s\n", colorYellow, target, err, colorReset)
+		}
+	}
+	return nil
+}
+
+func saveMarkdown(out io.Writer, conversation *Conversation, filename string, config *Config) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+
+	if err := os.WriteFile(filename, []byte(renderMarkdown(conversation.getTitle(), conversation.getHistory(), config)), 0644); err != nil {
+		return fmt.Errorf("failed to write markdown file: %w", err)
+	}
+
+	fmt.Fprintf(out, "%sConversation exported to %s%s\n", colorGreen, filename, colorReset)
+	return nil
+}
+
+func renderMarkdown(title string, history []Message, config *Config) string {
+	if title == "" {
+		title = "Conversation"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+	for _, msg := range history {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", config.roleLabel(msg.Role), strings.TrimSpace(msg.Content))
+	}
+	return b.String()
+}
+
+func openFile(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	return cmd.Start()
+}
+
+func handleExportHTMLCommand(userInput string, session *ChatSession) error {
+	config := session.apiClient.config
+	target := strings.TrimSpace(strings.TrimPrefix(userInput, "/export-html"))
+	switch {
+	case target == "":
+		target = filepath.Join(config.SessionsDir, fmt.Sprintf("conversation_%s.html", time.Now().Format("20060102_150405")))
+	case !filepath.IsAbs(target):
+		target = filepath.Join(config.SessionsDir, target)
+	}
+
+	page, err := renderHTML(session.conversation.getTitle(), session.conversation.getHistory(), config)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError rendering conversation: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		fmt.Fprintf(session.out, "%sError creating directory: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	if err := os.WriteFile(target, []byte(page), 0644); err != nil {
+		fmt.Fprintf(session.out, "%sError writing HTML file: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	fmt.Fprintf(session.out, "%sConversation exported to %s%s\n", colorGreen, target, colorReset)
+
+	if config.OpenExports {
+		if err := openFile(target); err != nil {
+			fmt.Fprintf(session.out, "%sCould not open %s: %v%s\n", colorYellow, target, err, colorReset)
+		}
+	}
+	return nil
+}
+
+func renderHTML(title string, history []Message, config *Config) (string, error) {
+	if title == "" {
+		title = "Conversation"
+	}
+
+	style := styles.Get("github")
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+
+	var css strings.Builder
+	if err := formatter.WriteCSS(&css, style); err != nil {
+		return "", fmt.Errorf("failed to render highlighting styles: %w", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n%s%s</style>\n</head>\n<body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), htmlPageStyle, css.String(), html.EscapeString(title))
+	for _, msg := range history {
+		fmt.Fprintf(&b, "<section class=\"%s\">\n<h2>%s</h2>\n", html.EscapeString(msg.Role), html.EscapeString(config.roleLabel(msg.Role)))
+		if err := renderHTMLContent(&b, msg.Content, formatter, style); err != nil {
+			return "", err
+		}
+		b.WriteString("</section>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String(), nil
+}
+
+func renderHTMLContent(b *strings.Builder, content string, formatter *chromahtml.Formatter, style *chroma.Style) error {
+	var text, code []string
+	language := ""
+	inCode := false
+
+	flushText := func() {
+		for _, paragraph := range strings.Split(strings.Join(text, "\n"), "\n\n") {
+			if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+				fmt.Fprintf(b, "<p>%s</p>\n", strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>\n"))
+			}
+		}
+		text = nil
+	}
+
+	flushCode := func() error {
+		source := strings.Join(code, "\n")
+		lexer := lexers.Get(language)
+		if lexer == nil {
+			lexer = lexers.Analyse(source)
+		}
+		if lexer == nil {
+			lexer = lexers.Fallback
+		}
+		iterator, err := chroma.Coalesce(lexer).Tokenise(nil, source)
+		if err != nil {
+			return fmt.Errorf("failed to highlight code: %w", err)
+		}
+		if err := formatter.Format(b, style, iterator); err != nil {
+			return fmt.Errorf("failed to highlight code: %w", err)
+		}
+		code = nil
+		return nil
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inCode {
+				if err := flushCode(); err != nil {
+					return err
+				}
+			} else {
+				flushText()
+				language = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "```"))
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			code = append(code, line)
+		} else {
+			text = append(text, line)
+		}
+	}
+
+	if inCode {
+		return flushCode()
+	}
+	flushText()
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var commandHelp = []struct {
+	usage       string
+	description string
+}{
+	{"/help", "show this help"},
+	{"/save [name|all]", "save the conversation (or every branch)"},
+	{"/save-md [file]", "export the conversation as Markdown"},
+	{"/export-html [file]", "export the conversation as a standalone HTML page"},
+	{"/load <name>", "load a saved conversation"},
+	{"/template [name]", "list templates or start a conversation from one"},
+	{"/list", "list saved conversations"},
+	{"/rename [title]", "show or set the session title"},
+	{"/history [n|full]", "show the last n messages, or all of them untruncated"},
+	{"/last [n]", "reprint the last n responses"},
+	{"/clear", "reset the conversation, keeping the system prompt"},
+	{"/cls", "clear the terminal without touching the conversation"},
+	{"/model [name]", "show or switch the model"},
+	{"/models", "list the models the provider offers"},
+	{"/profile [name]", "show or switch the provider profile"},
+	{"/preset [name]", "show or switch the sampling preset"},
+	{"/maxtokens [n|reset]", "show or set the output token limit"},
+	{"/window [tokens]", "show or set the history truncation window"},
+	{"/prefill [text|clear]", "seed the start of assistant replies"},
+	{"/json", "toggle JSON response mode"},
+	{"/think", "toggle display of model reasoning"},
+	{"/prompt [name]", "list prompts or prepend one to the next message"},
+	{"/image <path-or-url>", "attach an image to the next message"},
+	{"/url <link>", "add a web page's text to the next message"},
+	{"/with <text>, /with !<command>", "attach context to the next request without storing it"},
+	{"/count [text]", "estimate tokens for text or the next message"},
+	{"/pin <index>, /unpin <index>", "keep a message through truncation"},
+	{"/roles [fix]", "check role alternation and merge repeats"},
+	{"/queue", "queue messages instead of sending them"},
+	{"/run", "send the queued messages one by one"},
+	{"/showqueue, /clearqueue", "list or discard queued messages"},
+	{"/branch <name>", "fork the conversation into a new branch"},
+	{"/switch <name>", "switch to another branch"},
+	{"/branches", "list branches"},
+	{"/compare <prompt>", "ask every model in compare_models the same question"},
+	{"/replay", "replay the conversation"},
+	{"/wrap <columns|0|off>", "set the word-wrap width"},
+	{"/cost", "show token usage and estimated cost"},
+	{"/verbose [on|off]", "show or switch debug logging"},
+	{"/config", "show the effective configuration"},
+}
+
+func handleHelpCommand(session *ChatSession) error {
+	config := session.apiClient.config
+	fmt.Fprintf(session.out, "%sCommands:%s\n", colorCyan, colorReset)
+	for _, command := range commandHelp {
+		fmt.Fprintf(session.out, "  %-30s %s\n", command.usage, command.description)
+	}
+	fmt.Fprintf(session.out, "\nStart a message with \"//\" to send text beginning with \"/\" instead of running a command.\n")
+	fmt.Fprintf(session.out, "Type '%s' or press Ctrl+D to quit.\n", strings.Join(config.ExitCommands, "', '"))
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxImageBytes = 4 * 1024 * 1024
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+func handleImageCommand(userInput string, session *ChatSession) error {
+	source := strings.TrimSpace(strings.TrimPrefix(userInput, "/image"))
+	if source == "" {
+		fmt.Fprintf(session.out, "%sUsage: /image <path-or-url>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	model := session.apiClient.model
+	if !session.apiClient.config.modelProfile(model).Vision {
+		fmt.Fprintf(session.out, "%s%s does not accept images; set vision: true in its model profile if it does.%s\n", colorRed, model, colorReset)
+		return nil
+	}
+
+	url, err := imageURL(source)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError attaching image: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+
+	session.pendingImages = append(session.pendingImages, url)
+	fmt.Fprintf(session.out, "%sImage attached to your next message (%d pending).%s\n", colorGreen, len(session.pendingImages), colorReset)
+	return nil
+}
+
+func imageURL(source string) (string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "data:") {
+		return source, nil
+	}
+
+	data, err := os.ReadFile(expandHome(source))
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(data) > maxImageBytes {
+		return "", fmt.Errorf("image is %d bytes, exceeding the limit of %d", len(data), maxImageBytes)
+	}
+
+	mediaType := mime.TypeByExtension(strings.ToLower(filepath.Ext(source)))
+	if mediaType == "" {
+		mediaType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("%s does not look like an image (%s)", source, mediaType)
+	}
+
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func messageContent(msg Message, vision bool) interface{} {
+	if len(msg.Images) == 0 || !vision {
+		return msg.Content
+	}
+
+	parts := []ContentPart{{Type: "text", Text: msg.Content}}
+	for _, url := range msg.Images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+	return parts
+}
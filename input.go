@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	errIdleTimeout   = errors.New("idle timeout exceeded")
+	errInterrupted   = errors.New("interrupted")
+	errTerminated    = errors.New("terminated")
+	errStreamStalled = errors.New("stream stalled")
+)
+
+var typographicReplacer = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201a", "'", "\u201b", "'", "\u2032", "'",
+	"\u201c", "\"", "\u201d", "\"", "\u201e", "\"", "\u201f", "\"", "\u2033", "\"",
+	"\u2013", "-", "\u2014", "-", "\u2212", "-",
+	"\u2026", "...",
+	"\u00a0", " ", "\u2007", " ", "\u2009", " ", "\u202f", " ",
+)
+
+func normalizeInput(s string) string {
+	s = typographicReplacer.Replace(s)
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || r == '\ufeff' || r == '\u200b' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+type LineReader struct {
+	lines   chan string
+	pending []string
+	closed  bool
+}
+
+func newLineReader(r io.Reader) *LineReader {
+	reader := &LineReader{lines: make(chan string)}
+	go func() {
+		defer close(reader.lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			reader.lines <- scanner.Text()
+		}
+	}()
+	return reader
+}
+
+func (r *LineReader) readLine(ctx context.Context, timeout time.Duration) (string, error) {
+	var idle <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	if len(r.pending) > 0 {
+		line := r.pending[0]
+		r.pending = r.pending[1:]
+		return strings.TrimSpace(line), nil
+	}
+	if r.closed {
+		return "", io.EOF
+	}
+
+	select {
+	case line, ok := <-r.lines:
+		if !ok {
+			r.closed = true
+			return "", io.EOF
+		}
+		return strings.TrimSpace(line), nil
+	case <-idle:
+		return "", errIdleTimeout
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (r *LineReader) skipRequested() bool {
+	if r == nil || r.closed {
+		return false
+	}
+	select {
+	case line, ok := <-r.lines:
+		if !ok {
+			r.closed = true
+			return false
+		}
+		if strings.TrimSpace(line) != "" {
+			r.pending = append(r.pending, line)
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	minLoopUnit = 10
+	maxLoopUnit = 200
+)
+
+var errLoopDetected = errors.New("response is repeating itself")
+
+func detectLoop(text string, threshold int) bool {
+	if threshold < 2 {
+		return false
+	}
+	runes := []rune(text)
+	for unit := minLoopUnit; unit <= maxLoopUnit; unit++ {
+		span := unit * threshold
+		if span > len(runes) {
+			break
+		}
+		tail := runes[len(runes)-span:]
+		if slices.Equal(tail[unit:], tail[:span-unit]) && !isSingleRune(tail[:unit]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSingleRune(runes []rune) bool {
+	for _, r := range runes[1:] {
+		if r != runes[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ChatSession) handleLoopDetected(ctx context.Context) error {
+	fmt.Fprintf(s.out, "%sThe response started repeating itself and was stopped.%s\n", colorYellow, colorReset)
+	if s.input == nil || !s.terminal.Interactive {
+		s.conversation.removeTrailingUserMessage()
+		return nil
+	}
+
+	fmt.Fprintf(s.out, "%sRegenerate? [y/N]%s ", colorYellow, colorReset)
+	answer, err := s.input.readLine(ctx, 0)
+	if err != nil || !strings.EqualFold(answer, "y") {
+		s.conversation.removeTrailingUserMessage()
+		fmt.Fprintf(s.out, "%sYour message was removed from the history.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	if boost := s.apiClient.config.LoopPenaltyBoost; boost > 0 {
+		previous := s.apiClient.penaltyBoost
+		s.apiClient.penaltyBoost += boost
+		defer func() { s.apiClient.penaltyBoost = previous }()
+	}
+	return s.respond(ctx)
+}
@@ -4,302 +4,2277 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	maxTokens              = 8000
-	apiURL                 = "https://api.groq.com/openai/v1/chat/completions"
-	initialHistoryCapacity = 10
-	configFile             = "config.yaml"
-	timeoutSeconds         = 30
-	exitCommand            = "exit"
-	maxRetries             = 3
-	backoffFactor          = 2
-	initialBackoff         = 1 * time.Second
-	maxConversationTokens  = 4000
-	systemPromptFile       = "system_prompt.txt"
-	requestsPerSecond      = 10
+	defaultModel              = "llama-3.1-70b-versatile"
+	apiBaseURL                = "https://api.groq.com/openai/v1"
+	initialHistoryCapacity    = 10
+	configFile                = "config.yaml"
+	appName                   = "aichat"
+	timeoutSeconds            = 30
+	exitCommand               = "exit"
+	maxRetries                = 3
+	backoffFactor             = 2
+	initialBackoff            = 1 * time.Second
+	maxConversationTokens     = 4000
+	systemPromptFile          = "system_prompt.txt"
+	requestsPerSecond         = 10
+	maxStreamLineSize         = 1024 * 1024
+	defaultBranch             = "main"
+	defaultAPIKeyPrefix       = "gsk_"
+	minAPIKeyLength           = 20
+	wrapTerminalWidth         = -1
+	defaultAssistantLabel     = "AI"
+	defaultUserLabel          = "You"
+	defaultContextBudgetBytes = 16 * 1024
+	defaultGreetingPrompt     = "Introduce yourself briefly."
+	defaultStreamDelayMillis  = 50
+	maxTokensDirective        = "!max="
+	defaultSummaryExchanges   = 3
+	defaultSummaryMaxChars    = 50
+	defaultPreset             = "balanced"
+	defaultBatchDelimiter     = "\n\n"
+	defaultThinkingText       = "thinking…"
+	defaultTurnSpacing        = 1
+	defaultStreamStallTimeout = 15 * time.Second
 )
 
+var defaultModelProfiles = map[string]ModelProfile{
+	"llama-3.1-70b-versatile":      {ContextWindow: 131072, MaxOutputTokens: 8000},
+	"llama-3.1-8b-instant":         {ContextWindow: 131072, MaxOutputTokens: 8000},
+	"llama3-70b-8192":              {ContextWindow: 8192, MaxOutputTokens: 2048},
+	"llama3-8b-8192":               {ContextWindow: 8192, MaxOutputTokens: 2048},
+	"mixtral-8x7b-32768":           {ContextWindow: 32768, MaxOutputTokens: 4096},
+	"gemma2-9b-it":                 {ContextWindow: 8192, MaxOutputTokens: 2048},
+	"llama-3.2-11b-vision-preview": {ContextWindow: 8192, MaxOutputTokens: 8192, Vision: true},
+	"llama-3.2-90b-vision-preview": {ContextWindow: 8192, MaxOutputTokens: 8192, Vision: true},
+}
+
+var defaultSamplingPresets = map[string]SamplingPreset{
+	"precise":  {Temperature: 0.2, TopP: 0.5},
+	"balanced": {Temperature: 0.7, TopP: 0.9},
+	"creative": {Temperature: 1.0, TopP: 0.95},
+}
+
+const minStopFragment = 4
+
+var stopSequences = []string{"\n\nHuman:", "\n\nAssistant:"}
+
+var envVarPattern = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}|\$[A-Za-z_][A-Za-z0-9_]*`)
+
+var version = "1.0"
+
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+var fallbackModelProfile = ModelProfile{ContextWindow: 8192, MaxOutputTokens: 1024}
+
 type Config struct {
-	GroqAPIKey string `yaml:"groq_api_key"`
+	GroqAPIKey          string                     `yaml:"groq_api_key"`
+	APIKeyPrefix        string                     `yaml:"api_key_prefix"`
+	APIKeyFile          string                     `yaml:"api_key_file"`
+	BaseURL             string                     `yaml:"base_url"`
+	Profile             string                     `yaml:"profile"`
+	Profiles            map[string]ProviderProfile `yaml:"profiles"`
+	Model               string                     `yaml:"model"`
+	ModelProfiles       map[string]ModelProfile    `yaml:"model_profiles"`
+	FrequencyPenalty    float64                    `yaml:"frequency_penalty"`
+	PresencePenalty     float64                    `yaml:"presence_penalty"`
+	Seed                *int                       `yaml:"seed"`
+	IdleTimeout         time.Duration              `yaml:"idle_timeout"`
+	Prompts             map[string]string          `yaml:"prompts"`
+	InjectDateTime      bool                       `yaml:"inject_datetime"`
+	ReplayDelay         time.Duration              `yaml:"replay_delay"`
+	MaxUserInputChars   int                        `yaml:"max_user_input_chars"`
+	Timezone            string                     `yaml:"timezone"`
+	DateTimeFormat      string                     `yaml:"datetime_format"`
+	ContinueOnError     *bool                      `yaml:"continue_on_error"`
+	EventLogFile        string                     `yaml:"event_log_file"`
+	StreamFlushInterval time.Duration              `yaml:"stream_flush_interval"`
+	ExtraHeaders        map[string]string          `yaml:"extra_headers"`
+	Autosave            bool                       `yaml:"autosave"`
+	AssistantLabel      string                     `yaml:"assistant_label"`
+	UserLabel           string                     `yaml:"user_label"`
+	ExitCommands        []string                   `yaml:"exit_commands"`
+	Pricing             map[string]ModelPricing    `yaml:"pricing"`
+	ContextBudgetBytes  int                        `yaml:"context_budget_bytes"`
+	Greet               bool                       `yaml:"greet"`
+	GreetingPrompt      string                     `yaml:"greeting_prompt"`
+	KeepFullHistory     bool                       `yaml:"keep_full_history"`
+	SessionsDir         string                     `yaml:"sessions_dir"`
+	TemplatesDir        string                     `yaml:"templates_dir"`
+	FallbackModels      []string                   `yaml:"fallback_models"`
+	RetryJitter         string                     `yaml:"retry_jitter"`
+	CompareModels       []string                   `yaml:"compare_models"`
+	MaxHistoryMessages  int                        `yaml:"max_history_messages"`
+	StreamDelayMillis   int                        `yaml:"stream_delay_millis"`
+	UserAgent           string                     `yaml:"user_agent"`
+	RequestIDHeader     string                     `yaml:"request_id_header"`
+	OpenExports         bool                       `yaml:"open_exports"`
+	SummaryExchanges    int                        `yaml:"summary_exchanges"`
+	SummaryMaxChars     int                        `yaml:"summary_max_chars"`
+	ConfirmAboveTokens  int                        `yaml:"confirm_above_tokens"`
+	MaxSessionCost      float64                    `yaml:"max_session_cost"`
+	AllowShellCommands  bool                       `yaml:"allow_shell_commands"`
+	SamplingPresets     map[string]SamplingPreset  `yaml:"sampling_presets"`
+	Preset              string                     `yaml:"preset"`
+	BatchDelimiter      string                     `yaml:"batch_delimiter"`
+	Prefill             string                     `yaml:"prefill"`
+	LoopRepeatThreshold int                        `yaml:"loop_repeat_threshold"`
+	LoopPenaltyBoost    float64                    `yaml:"loop_penalty_boost"`
+	Transport           TransportConfig            `yaml:"transport"`
+	ThinkingText        string                     `yaml:"thinking_text"`
+	ShowStreamStats     bool                       `yaml:"show_stream_stats"`
+	NormalizeInput      bool                       `yaml:"normalize_input"`
+	EchoSentInput       bool                       `yaml:"echo_sent_input"`
+	ResponsePrefix      string                     `yaml:"response_prefix"`
+	ResponseSuffix      string                     `yaml:"response_suffix"`
+	EmptyResponse       string                     `yaml:"empty_response"`
+	KeepPartialReplies  bool                       `yaml:"keep_partial_replies"`
+	TurnSpacing         int                        `yaml:"turn_spacing"`
+	Storage             string                     `yaml:"storage"`
+	SQLitePath          string                     `yaml:"sqlite_path"`
+	ShowReasoning       bool                       `yaml:"show_reasoning"`
+	TrimStopFragments   bool                       `yaml:"trim_stop_fragments"`
+	StreamStallTimeout  time.Duration              `yaml:"stream_stall_timeout"`
+	JSONMode            bool                       `yaml:"json_mode"`
+
+	// LogitBias maps token IDs to a bias between -100 and 100. Token IDs are
+	// model-specific, so a bias only fits the model it was written for.
+	LogitBias map[string]float64 `yaml:"logit_bias"`
+
+	location         *time.Location
+	systemPromptPath string
+}
+
+type ModelPricing struct {
+	InputPerMillion  float64 `yaml:"input_per_million"`
+	OutputPerMillion float64 `yaml:"output_per_million"`
+}
+
+type ProviderProfile struct {
+	BaseURL      string  `yaml:"base_url"`
+	Model        string  `yaml:"model"`
+	APIKey       string  `yaml:"api_key"`
+	APIKeyFile   string  `yaml:"api_key_file"`
+	APIKeyPrefix *string `yaml:"api_key_prefix"`
+}
+
+type TransportConfig struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DisableCompression  bool          `yaml:"disable_compression"`
+	ForceAttemptHTTP2   bool          `yaml:"force_attempt_http2"`
+
+	// DisableHTTP2 forces HTTP/1.1. Use it behind proxies or middleboxes
+	// that break HTTP/2 streaming and leave responses hanging.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+}
+
+type SamplingPreset struct {
+	Temperature float64 `yaml:"temperature"`
+	TopP        float64 `yaml:"top_p"`
+}
+
+type ModelProfile struct {
+	ContextWindow   int  `yaml:"context_window"`
+	MaxOutputTokens int  `yaml:"max_output_tokens"`
+	Vision          bool `yaml:"vision"`
+}
+
+type Message struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"-"`
+	Pinned    bool      `json:"pinned,omitempty"`
+	Images    []string  `json:"images,omitempty"`
+}
+
+type APIMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type Conversation struct {
+	Title              string
+	History            []Message
+	mu                 sync.RWMutex
+	tokenCount         int
+	keepFullHistory    bool
+	maxHistoryMessages int
+	maxTokens          int
+	dirty              bool
+}
+
+type APIClient struct {
+	httpClient   *http.Client
+	apiKey       string
+	rateLimiter  *time.Ticker
+	config       *Config
+	baseURL      string
+	model        string
+	preset       string
+	prefill      string
+	maxTokens    int
+	penaltyBoost float64
+	examples     []Message
+	ephemeral    []string
+
+	jsonMode    bool
+	modelsCache modelsCache
+	events      EventSink
+	usage       UsageTracker
+	randMu      sync.Mutex
+	rand        *rand.Rand
+}
+
+type PartialResponseError struct {
+	Partial AIResponse
+	Err     error
+}
+
+func (e *PartialResponseError) Error() string {
+	return fmt.Sprintf("stream failed after %d characters: %v", len(e.Partial.Content), e.Err)
+}
+
+func (e *PartialResponseError) Unwrap() error {
+	return e.Err
+}
+
+type APIError struct {
+	StatusCode int
+	Body       string
+	RequestID  string
+	ProviderID string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API request failed with status %d (%s): %s", e.StatusCode, describeRequestIDs(e.RequestID, e.ProviderID), e.Body)
+}
+
+type AIResponse struct {
+	Content    string
+	Reasoning  string
+	Usage      *Usage
+	Model      string
+	RequestID  string
+	ProviderID string
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ChatSession struct {
+	apiClient      *APIClient
+	conversation   *Conversation
+	input          *LineReader
+	out            io.Writer
+	terminal       Terminal
+	quiet          bool
+	wrapWidth      int
+	showReasoning  bool
+	pendingPrompt  string
+	countNext      bool
+	pendingImages  []string
+	pendingPages   []string
+	pendingContext []string
+	queue          []string
+	queueing       bool
+
+	responseLog *ResponseLogger
+	store       ConversationStore
+
+	branches      map[string]*Conversation
+	currentBranch string
+
+	interruptCancel atomic.Pointer[context.CancelFunc]
+	autosaveOnExit  bool
+	retryingEmpty   bool
+	shutdownOnce    sync.Once
+}
+
+type Flags struct {
+	ConfigPath    string
+	PickModel     bool
+	Quiet         bool
+	Verbose       bool
+	StopOnError   bool
+	Seed          *int
+	ContextGlobs  []string
+	LogJSONL      string
+	Check         bool
+	Batch         bool
+	Examples      string
+	Profile       string
+	NullDelimit   bool
+	ReplayRequest string
+	Template      string
+	Deadline      time.Duration
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("%sError: %v%s\n", colorRed, err, colorReset)
+	}
+}
+
+func run() (err error) {
+	flags := parseFlags()
+	ctx := context.Background()
+	if flags.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.Deadline)
+		defer cancel()
+		defer func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("deadline of %v exceeded", flags.Deadline)
+			}
+		}()
+	}
+	if flags.Verbose {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	configPath, err := findConfigFile(flags.ConfigPath)
+	if err != nil {
+		return err
+	}
+	slog.Debug("using config file", "path", configPath)
+
+	config, err := loadConfig(configPath, flags.Profile)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if flags.Seed != nil {
+		config.Seed = flags.Seed
+	}
+
+	if flags.StopOnError {
+		stop := false
+		config.ContinueOnError = &stop
+	}
+
+	apiClient := newAPIClient(config)
+	if flags.Examples != "" {
+		examples, err := loadExamples(flags.Examples)
+		if err != nil {
+			return fmt.Errorf("failed to load examples: %w", err)
+		}
+		apiClient.examples = examples
+	}
+	if config.EventLogFile != "" {
+		sink, err := newJSONLinesEventSink(config.EventLogFile)
+		if err != nil {
+			return fmt.Errorf("failed to open event log: %w", err)
+		}
+		defer sink.Close()
+		apiClient.events = sink
+	}
+	if flags.ReplayRequest != "" {
+		defer apiClient.close()
+		return replayRequest(ctx, apiClient, flags.ReplayRequest, os.Stdout)
+	}
+
+	conversation, err := newConversation(config.systemPromptPath)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation: %w", err)
+	}
+	if flags.Template != "" {
+		template, err := loadTemplate(config.TemplatesDir, flags.Template, config.systemPromptPath)
+		if err != nil {
+			return err
+		}
+		conversation.replaceWith(template)
+		conversation.markSaved()
+	}
+	conversation.keepFullHistory = config.KeepFullHistory
+	conversation.maxHistoryMessages = config.MaxHistoryMessages
+
+	terminal := detectTerminal()
+	if !terminal.SupportsColor {
+		disableColors()
+	}
+
+	session := &ChatSession{
+		apiClient:     apiClient,
+		conversation:  conversation,
+		out:           os.Stdout,
+		terminal:      terminal,
+		quiet:         flags.Quiet,
+		showReasoning: config.ShowReasoning,
+		wrapWidth:     wrapTerminalWidth,
+		branches:      make(map[string]*Conversation),
+		currentBranch: defaultBranch,
+	}
+
+	store, err := newConversationStore(config, session.out)
+	if err != nil {
+		return fmt.Errorf("failed to open conversation store: %w", err)
+	}
+	session.store = store
+
+	if flags.LogJSONL != "" {
+		session.responseLog = newResponseLogger(flags.LogJSONL, config.GroqAPIKey)
+	}
+
+	if flags.Check {
+		if err := checkConnection(ctx, apiClient); err != nil {
+			return fmt.Errorf("startup check failed: %w", err)
+		}
+	}
+
+	batch := flags.Batch || flags.NullDelimit || !terminal.Interactive
+	if config.ContinueOnError == nil && batch {
+		stop := false
+		config.ContinueOnError = &stop
+	}
+	if !batch {
+		session.input = newLineReader(os.Stdin)
+	}
+
+	if flags.PickModel && !batch {
+		pickModel(ctx, apiClient, session.input)
+	}
+
+	if !session.quiet && !batch {
+		printWelcomeMessage(session.out, session.terminal, config.ExitCommands[0])
+	}
+
+	if len(flags.ContextGlobs) > 0 {
+		if err := loadContextFiles(conversation, flags.ContextGlobs, config.ContextBudgetBytes); err != nil {
+			return fmt.Errorf("failed to load context files: %w", err)
+		}
+	}
+
+	if batch {
+		delimiter := config.BatchDelimiter
+		if flags.NullDelimit {
+			delimiter = "\x00"
+		}
+		return runBatch(ctx, session, os.Stdin, delimiter)
+	}
+	return runChatLoop(ctx, session)
+}
+
+func parseFlags() *Flags {
+	flags := &Flags{}
+	flag.StringVar(&flags.ConfigPath, "config", "", "path to the config file")
+	flag.BoolVar(&flags.PickModel, "pick-model", false, "choose a model from the provider's model list at startup")
+	flag.BoolVar(&flags.Quiet, "quiet", false, "suppress the welcome banner and progress spinner")
+	flag.BoolVar(&flags.Verbose, "verbose", false, "enable debug logging")
+	flag.BoolVar(&flags.StopOnError, "stop-on-error", false, "exit with an error when a request fails after all retries")
+	flag.BoolVar(&flags.Check, "check", false, "verify the API key and connectivity before starting the chat")
+	flag.BoolVar(&flags.Batch, "batch", false, "send each delimited prompt read from stdin as a separate one-shot request (the default when stdin is not a terminal)")
+	flag.BoolVar(&flags.NullDelimit, "0", false, "like -batch, but prompts are separated by NUL characters")
+	flag.StringVar(&flags.Examples, "examples", "", "JSON file of few-shot example messages sent with every request")
+	flag.StringVar(&flags.Profile, "profile", "", "use a named provider profile from the config file")
+	flag.StringVar(&flags.ReplayRequest, "replay-request", "", "re-send a logged chat completion request body from a file and print the raw response")
+	flag.StringVar(&flags.Template, "template", "", "start from a named conversation template in the templates directory")
+	flag.DurationVar(&flags.Deadline, "deadline", 0, "abort the whole run, including retries and batch items, after this duration")
+	flag.StringVar(&flags.LogJSONL, "log-jsonl", "", "append each completed exchange to a JSONL file")
+	flag.Func("context", "load files matching a glob into the conversation at startup (repeatable)", func(value string) error {
+		flags.ContextGlobs = append(flags.ContextGlobs, value)
+		return nil
+	})
+	flag.Func("seed", "sampling seed for reproducible outputs (overrides config)", func(value string) error {
+		seed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid seed: %w", err)
+		}
+		flags.Seed = &seed
+		return nil
+	})
+	flag.Parse()
+	return flags
+}
+
+func findConfigFile(explicitPath string) (string, error) {
+	if explicitPath != "" {
+		if _, err := os.Stat(explicitPath); err != nil {
+			return "", fmt.Errorf("config file %s not found: %w", explicitPath, err)
+		}
+		return explicitPath, nil
+	}
+
+	candidates := configFileCandidates()
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no config file found, searched: %s", strings.Join(candidates, ", "))
+}
+
+func configFileCandidates() []string {
+	var candidates []string
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		candidates = append(candidates, filepath.Join(configHome, appName, configFile))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".config", appName, configFile))
+	}
+	return append(candidates, configFile)
+}
+
+func loadConfig(path, profile string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	config := Config{
+		InjectDateTime:     true,
+		APIKeyPrefix:       defaultAPIKeyPrefix,
+		AssistantLabel:     defaultAssistantLabel,
+		UserLabel:          defaultUserLabel,
+		ExitCommands:       []string{exitCommand, "quit"},
+		ContextBudgetBytes: defaultContextBudgetBytes,
+		GreetingPrompt:     defaultGreetingPrompt,
+		DateTimeFormat:     time.RFC3339,
+		StreamDelayMillis:  defaultStreamDelayMillis,
+		UserAgent:          "AIChat/" + version,
+		RequestIDHeader:    "X-Request-Id",
+		SummaryExchanges:   defaultSummaryExchanges,
+		SummaryMaxChars:    defaultSummaryMaxChars,
+		Preset:             defaultPreset,
+		BatchDelimiter:     defaultBatchDelimiter,
+		ThinkingText:       defaultThinkingText,
+		Storage:            "json",
+		RetryJitter:        "equal",
+		EmptyResponse:      "warn",
+		BaseURL:            apiBaseURL,
+
+		TrimStopFragments:  true,
+		NormalizeInput:     true,
+		StreamStallTimeout: defaultStreamStallTimeout,
+
+		TurnSpacing: defaultTurnSpacing,
+
+		Transport: TransportConfig{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			MaxConnsPerHost:     100,
+			IdleConnTimeout:     90 * time.Second,
+			DisableCompression:  true,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	config.expandEnv()
+
+	if config.SessionsDir == "" {
+		config.SessionsDir = defaultSessionsDir()
+	}
+	config.SessionsDir = expandHome(config.SessionsDir)
+
+	if config.TemplatesDir == "" {
+		config.TemplatesDir = filepath.Join(filepath.Dir(path), "templates")
+	}
+	config.TemplatesDir = expandHome(config.TemplatesDir)
+
+	config.systemPromptPath = filepath.Join(filepath.Dir(path), systemPromptFile)
+	if _, err := os.Stat(config.systemPromptPath); err != nil {
+		config.systemPromptPath = systemPromptFile
+	}
+
+	if config.RetryJitter != "full" && config.RetryJitter != "equal" && config.RetryJitter != "none" {
+		return nil, fmt.Errorf("retry_jitter must be \"full\", \"equal\" or \"none\", got %q", config.RetryJitter)
+	}
+
+	if config.EmptyResponse != "warn" && config.EmptyResponse != "retry" {
+		return nil, fmt.Errorf("empty_response must be \"warn\" or \"retry\", got %q", config.EmptyResponse)
+	}
+
+	if config.Storage != "json" && config.Storage != "sqlite" {
+		return nil, fmt.Errorf("storage must be \"json\" or \"sqlite\", got %q", config.Storage)
+	}
+	if config.SQLitePath == "" {
+		config.SQLitePath = filepath.Join(config.SessionsDir, "conversations.db")
+	}
+	config.SQLitePath = expandHome(config.SQLitePath)
+
+	if config.APIKeyFile == "" {
+		config.APIKeyFile = os.Getenv("GROQ_API_KEY_FILE")
+	}
+
+	if profile != "" {
+		config.Profile = profile
+	}
+	if config.Profile != "" {
+		if err := config.applyProfile(config.Profile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.resolveAPIKey(); err != nil {
+		return nil, err
+	}
+
+	if err := validateBaseURL(config.BaseURL); err != nil {
+		return nil, err
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+
+	if config.Model == "" {
+		config.Model = defaultModel
+	}
+
+	if config.FrequencyPenalty < -2 || config.FrequencyPenalty > 2 {
+		return nil, fmt.Errorf("frequency_penalty must be between -2 and 2, got %v", config.FrequencyPenalty)
+	}
+
+	if config.PresencePenalty < -2 || config.PresencePenalty > 2 {
+		return nil, fmt.Errorf("presence_penalty must be between -2 and 2, got %v", config.PresencePenalty)
+	}
+
+	for token, bias := range config.LogitBias {
+		if _, err := strconv.Atoi(token); err != nil {
+			return nil, fmt.Errorf("logit_bias key %q is not a token ID", token)
+		}
+		if bias < -100 || bias > 100 {
+			return nil, fmt.Errorf("logit_bias for token %s must be between -100 and 100, got %v", token, bias)
+		}
+	}
+
+	if config.IdleTimeout < 0 {
+		return nil, errors.New("idle_timeout must not be negative")
+	}
+
+	if strings.TrimSpace(config.UserAgent) == "" || strings.ContainsAny(config.UserAgent, "\r\n") {
+		return nil, fmt.Errorf("user_agent must be a non-empty single line, got %q", config.UserAgent)
+	}
+
+	for name, value := range config.ExtraHeaders {
+		if !headerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid header name %q in extra_headers", name)
+		}
+		if strings.EqualFold(name, "Authorization") {
+			return nil, errors.New("extra_headers must not override Authorization")
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %q in extra_headers contains a line break", name)
+		}
+	}
+
+	if config.MaxHistoryMessages < 0 {
+		return nil, errors.New("max_history_messages must not be negative")
+	}
+
+	if config.ContextBudgetBytes < 0 {
+		return nil, errors.New("context_budget_bytes must not be negative")
+	}
+
+	if config.StreamFlushInterval < 0 {
+		return nil, errors.New("stream_flush_interval must not be negative")
+	}
+
+	if config.SummaryExchanges < 0 {
+		return nil, errors.New("summary_exchanges must not be negative")
+	}
+
+	if config.SummaryMaxChars <= 0 {
+		return nil, errors.New("summary_max_chars must be positive")
+	}
+
+	if len(config.ExitCommands) == 0 {
+		return nil, errors.New("exit_commands must not be empty")
+	}
+	for _, command := range config.ExitCommands {
+		if strings.TrimSpace(command) == "" || strings.HasPrefix(command, "/") {
+			return nil, fmt.Errorf("invalid exit command %q", command)
+		}
+	}
+
+	if config.MaxSessionCost < 0 {
+		return nil, errors.New("max_session_cost must not be negative")
+	}
+
+	if config.ConfirmAboveTokens < 0 {
+		return nil, errors.New("confirm_above_tokens must not be negative")
+	}
+
+	if config.BatchDelimiter == "" {
+		return nil, errors.New("batch_delimiter must not be empty")
+	}
+
+	if config.LoopRepeatThreshold < 0 || config.LoopRepeatThreshold == 1 {
+		return nil, errors.New("loop_repeat_threshold must be 0 (off) or at least 2")
+	}
+
+	if config.LoopPenaltyBoost < 0 || config.LoopPenaltyBoost > 2 {
+		return nil, fmt.Errorf("loop_penalty_boost must be between 0 and 2, got %v", config.LoopPenaltyBoost)
+	}
+
+	transport := config.Transport
+	if transport.MaxIdleConns < 0 || transport.MaxIdleConnsPerHost < 0 || transport.MaxConnsPerHost < 0 {
+		return nil, errors.New("transport connection limits must not be negative")
+	}
+	if transport.MaxIdleConns > 1000 || transport.MaxIdleConnsPerHost > 1000 || transport.MaxConnsPerHost > 1000 {
+		return nil, errors.New("transport connection limits must not exceed 1000")
+	}
+	if transport.IdleConnTimeout < 0 {
+		return nil, errors.New("transport idle_conn_timeout must not be negative")
+	}
+
+	if config.TurnSpacing < 0 {
+		return nil, errors.New("turn_spacing must not be negative")
+	}
+
+	if strings.ContainsAny(config.RequestIDHeader, " :\r\n") {
+		return nil, fmt.Errorf("invalid request_id_header %q", config.RequestIDHeader)
+	}
+
+	if config.StreamStallTimeout < 0 {
+		return nil, errors.New("stream_stall_timeout must not be negative")
+	}
+
+	if config.StreamDelayMillis < 0 {
+		return nil, errors.New("stream_delay_millis must not be negative")
+	}
+
+	if config.ReplayDelay < 0 {
+		return nil, errors.New("replay_delay must not be negative")
+	}
+
+	if config.MaxUserInputChars < 0 {
+		return nil, errors.New("max_user_input_chars must not be negative")
+	}
+
+	if _, err := time.Parse(config.DateTimeFormat, time.Now().Format(config.DateTimeFormat)); err != nil || config.DateTimeFormat == "" {
+		return nil, fmt.Errorf("invalid datetime_format %q", config.DateTimeFormat)
+	}
+
+	config.location = time.Local
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", config.Timezone, err)
+		}
+		config.location = location
+	}
+
+	for model, pricing := range config.Pricing {
+		if pricing.InputPerMillion < 0 || pricing.OutputPerMillion < 0 {
+			return nil, fmt.Errorf("pricing for model %q must not be negative", model)
+		}
+	}
+
+	for name, preset := range config.SamplingPresets {
+		if preset.Temperature < 0 || preset.Temperature > 2 {
+			return nil, fmt.Errorf("sampling preset %q temperature must be between 0 and 2, got %v", name, preset.Temperature)
+		}
+		if preset.TopP <= 0 || preset.TopP > 1 {
+			return nil, fmt.Errorf("sampling preset %q top_p must be in (0, 1], got %v", name, preset.TopP)
+		}
+	}
+
+	if _, ok := config.samplingPreset(config.Preset); !ok {
+		return nil, fmt.Errorf("unknown sampling preset %q", config.Preset)
+	}
+
+	for model, profile := range config.ModelProfiles {
+		if profile.ContextWindow < 0 || profile.MaxOutputTokens < 0 {
+			return nil, fmt.Errorf("model profile %q has negative limits", model)
+		}
+		if merged := config.modelProfile(model); merged.MaxOutputTokens >= merged.ContextWindow {
+			return nil, fmt.Errorf("model profile %q: max_output_tokens must be smaller than context_window", model)
+		}
+	}
+
+	return &config, nil
+}
+
+func (c *Config) applyProfile(name string) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	c.Profile = name
+	if profile.BaseURL != "" {
+		c.BaseURL = expandEnv(profile.BaseURL)
+	}
+	if profile.Model != "" {
+		c.Model = expandEnv(profile.Model)
+	}
+	if profile.APIKeyPrefix != nil {
+		c.APIKeyPrefix = *profile.APIKeyPrefix
+	}
+	switch {
+	case profile.APIKey != "":
+		c.GroqAPIKey = expandEnv(profile.APIKey)
+		c.APIKeyFile = ""
+	case profile.APIKeyFile != "":
+		c.GroqAPIKey = ""
+		c.APIKeyFile = expandEnv(profile.APIKeyFile)
+	}
+	return nil
+}
+
+func (c *Config) resolveAPIKey() error {
+	if c.APIKeyFile != "" && c.GroqAPIKey == "" {
+		key, err := os.ReadFile(expandHome(c.APIKeyFile))
+		if err != nil {
+			return fmt.Errorf("failed to read API key file: %w", err)
+		}
+		c.GroqAPIKey = strings.TrimSpace(string(key))
+	}
+
+	if c.GroqAPIKey == "" {
+		return errors.New("GroqAPIKey is missing in the config file")
+	}
+
+	return validateAPIKey(c.GroqAPIKey, c.APIKeyPrefix)
+}
+
+func validateBaseURL(baseURL string) error {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("base_url must be an http or https URL, got %q", baseURL)
+	}
+	return nil
+}
+
+func validateAPIKey(apiKey, prefix string) error {
+	if strings.ContainsAny(apiKey, " \t\r\n") {
+		return errors.New("GroqAPIKey must not contain whitespace")
+	}
+
+	if prefix == "" {
+		return nil
+	}
+
+	if len(apiKey) < minAPIKeyLength {
+		return fmt.Errorf("GroqAPIKey looks truncated (%d characters, expected at least %d)", len(apiKey), minAPIKeyLength)
+	}
+
+	if !strings.HasPrefix(apiKey, prefix) {
+		return fmt.Errorf("GroqAPIKey does not start with %q; set api_key_prefix to \"\" to disable these checks", prefix)
+	}
+
+	return nil
+}
+
+func defaultSessionsDir() string {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, appName)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", appName)
+	}
+	return "."
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// expandEnv expands environment variables in groq_api_key, api_key_file,
+// base_url, model, timezone, sessions_dir, templates_dir, sqlite_path and the
+// prompts values. Profile fields are expanded by applyProfile.
+func (c *Config) expandEnv() {
+	c.GroqAPIKey = expandEnv(c.GroqAPIKey)
+	c.APIKeyFile = expandEnv(c.APIKeyFile)
+	c.BaseURL = expandEnv(c.BaseURL)
+	c.Model = expandEnv(c.Model)
+	c.Timezone = expandEnv(c.Timezone)
+	c.SessionsDir = expandEnv(c.SessionsDir)
+	c.TemplatesDir = expandEnv(c.TemplatesDir)
+	c.SQLitePath = expandEnv(c.SQLitePath)
+	for name, prompt := range c.Prompts {
+		c.Prompts[name] = expandEnv(prompt)
+	}
+}
+
+func expandEnv(s string) string {
+	return envVarPattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := strings.Trim(match, "${}")
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		return match
+	})
+}
+
+func (c *Config) continueOnError() bool {
+	return c.ContinueOnError == nil || *c.ContinueOnError
+}
+
+func (c *Config) roleLabel(role string) string {
+	switch role {
+	case "assistant":
+		return c.AssistantLabel
+	case "user":
+		return c.UserLabel
+	default:
+		return role
+	}
+}
+
+func (c *Config) isExitCommand(input string) bool {
+	for _, command := range c.ExitCommands {
+		if strings.EqualFold(input, command) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) samplingPreset(name string) (SamplingPreset, bool) {
+	if preset, ok := c.SamplingPresets[name]; ok {
+		return preset, true
+	}
+	preset, ok := defaultSamplingPresets[name]
+	return preset, ok
+}
+
+func (c *Config) samplingPresetNames() []string {
+	var names []string
+	for name := range defaultSamplingPresets {
+		names = append(names, name)
+	}
+	for name := range c.SamplingPresets {
+		if _, ok := defaultSamplingPresets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) modelProfile(model string) ModelProfile {
+	profile, ok := defaultModelProfiles[model]
+	if !ok {
+		profile = fallbackModelProfile
+	}
+
+	if override, ok := c.ModelProfiles[model]; ok {
+		if override.ContextWindow > 0 {
+			profile.ContextWindow = override.ContextWindow
+		}
+		if override.MaxOutputTokens > 0 {
+			profile.MaxOutputTokens = override.MaxOutputTokens
+		}
+		if override.Vision {
+			profile.Vision = true
+		}
+	}
+
+	return profile
+}
+
+func newAPIClient(config *Config) *APIClient {
+	transport := &http.Transport{
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+		MaxIdleConns:        config.Transport.MaxIdleConns,
+		MaxConnsPerHost:     config.Transport.MaxConnsPerHost,
+		IdleConnTimeout:     config.Transport.IdleConnTimeout,
+		DisableCompression:  config.Transport.DisableCompression,
+		ForceAttemptHTTP2:   config.Transport.ForceAttemptHTTP2,
+		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
+	}
+	if config.Transport.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &APIClient{
+		httpClient: &http.Client{
+			Timeout:   time.Second * timeoutSeconds,
+			Transport: transport,
+		},
+		apiKey:      config.GroqAPIKey,
+		rateLimiter: time.NewTicker(time.Second / requestsPerSecond),
+		config:      config,
+		baseURL:     config.BaseURL,
+		model:       config.Model,
+		preset:      config.Preset,
+		prefill:     config.Prefill,
+		jsonMode:    config.JSONMode,
+		events:      NoopEventSink{},
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (c *APIClient) int63n(n int64) int64 {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Int63n(n)
+}
+
+func (c *APIClient) close() {
+	c.rateLimiter.Stop()
+	c.httpClient.CloseIdleConnections()
+}
+
+func newConversation(systemPromptPath string) (*Conversation, error) {
+	systemPrompt, err := loadSystemPrompt(systemPromptPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load system prompt: %w", err)
+	}
+
+	return &Conversation{
+		History:    []Message{{Role: "system", Content: systemPrompt, Timestamp: time.Now()}},
+		tokenCount: len(strings.Fields(systemPrompt)),
+	}, nil
+}
+
+func loadSystemPrompt(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read system prompt file: %w", err)
+	}
+	return expandEnv(string(data)), nil
+}
+
+func printWelcomeMessage(out io.Writer, terminal Terminal, exitCommand string) {
+	welcomeMsg := "Welcome to the AI Chat!"
+	if !terminal.IsTTY {
+		fmt.Fprintf(out, "%s\nType '%s' to exit the program.\n\n", welcomeMsg, exitCommand)
+		return
+	}
+
+	if terminal.SupportsANSI {
+		clearScreen(out)
+	}
+	width := max(terminal.Width, len(welcomeMsg)+4)
+	border := strings.Repeat("─", width-4)
+
+	fmt.Fprintf(out, "%s┌%s┐\n", colorCyan, border)
+	fmt.Fprintf(out, "│%s%s%s│\n", strings.Repeat(" ", (width-len(welcomeMsg)-2)/2), welcomeMsg, strings.Repeat(" ", (width-len(welcomeMsg)-1)/2))
+	fmt.Fprintf(out, "└%s┘%s\n", border, colorReset)
+	fmt.Fprintf(out, "%sType '%s' to exit the program.%s\n\n", colorBlue, exitCommand, colorReset)
+}
+
+func runChatLoop(ctx context.Context, session *ChatSession) error {
+	greet := session.apiClient.config.Greet
+	for {
+		err := runChatGroup(ctx, session, greet)
+		greet = false
+		if errors.Is(err, errInterrupted) && !session.confirmExit(ctx) {
+			continue
+		}
+		session.shutdown()
+		if errors.Is(err, errInterrupted) || errors.Is(err, errTerminated) {
+			return nil
+		}
+		return err
+	}
+}
+
+func runChatGroup(ctx context.Context, session *ChatSession, greet bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g, groupCtx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return handleInterrupt(groupCtx, session)
+	})
+
+	g.Go(func() error {
+		defer cancel()
+		if greet {
+			if err := sendGreeting(groupCtx, session); err != nil {
+				return err
+			}
+		}
+		return processChatInputLoop(groupCtx, session)
+	})
+
+	return g.Wait()
+}
+
+func (s *ChatSession) confirmExit(ctx context.Context) bool {
+	if s.input == nil || !s.terminal.Interactive || s.apiClient.config.Autosave || !s.conversation.isDirty() {
+		return true
+	}
+
+	fmt.Fprintf(s.out, "%sSave before exiting? [y/N/cancel]%s ", colorYellow, colorReset)
+	answer, err := s.input.readLine(ctx, 0)
+	if err != nil {
+		return true
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		s.autosaveOnExit = true
+	case "c", "cancel":
+		return false
+	}
+	return true
+}
+
+func sendGreeting(ctx context.Context, session *ChatSession) error {
+	session.conversation.addMessage("user", session.apiClient.config.GreetingPrompt)
+	return session.respond(ctx)
+}
+
+func (s *ChatSession) shutdown() {
+	s.shutdownOnce.Do(func() {
+		if s.autosaveOnExit || s.apiClient.config.Autosave {
+			if err := s.store.Save("", s.conversation); err != nil {
+				fmt.Fprintf(s.out, "%sError saving conversation: %v%s\n", colorRed, err, colorReset)
+			}
+		}
+		if err := s.store.Close(); err != nil {
+			log.Printf("Error closing conversation store: %v", err)
+		}
+		s.apiClient.close()
+		fmt.Fprintf(s.out, "%sGoodbye!%s\n", colorYellow, colorReset)
+	})
+}
+
+func handleInterrupt(ctx context.Context, session *ChatSession) error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case sig := <-sigChan:
+			if cancel := session.interruptCancel.Load(); cancel != nil && sig == os.Interrupt {
+				(*cancel)()
+				continue
+			}
+			fmt.Fprintf(session.out, "\n%sReceived interrupt signal. Exiting...%s\n", colorYellow, colorReset)
+			if sig == syscall.SIGTERM {
+				return errTerminated
+			}
+			return errInterrupted
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *ChatSession) runInterruptible(ctx context.Context, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.interruptCancel.Store(&cancel)
+	defer s.interruptCancel.Store(nil)
+
+	fn(ctx)
+}
+
+func processChatInputLoop(ctx context.Context, session *ChatSession) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			if err := processChatInput(ctx, session); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+func processChatInput(ctx context.Context, session *ChatSession) error {
+	userInput, err := getUserInput(ctx, session)
+	if errors.Is(err, errIdleTimeout) {
+		return handleIdleTimeout(session)
+	}
+	if errors.Is(err, io.EOF) || (err == nil && session.apiClient.config.isExitCommand(userInput)) {
+		if !session.confirmExit(ctx) {
+			return nil
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	if userInput == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(userInput, "//") {
+		userInput = userInput[1:]
+	} else if handled, err := handleCommand(ctx, userInput, session); handled {
+		return err
+	}
+
+	if session.queueing {
+		session.queue = append(session.queue, userInput)
+		fmt.Fprintf(session.out, "%sQueued (%d pending). Type /run to send.%s\n", colorDim, len(session.queue), colorReset)
+		return nil
+	}
+	return sendUserInput(ctx, session, userInput)
+}
+
+func sendUserInput(ctx context.Context, session *ChatSession, userInput string) error {
+	if session.apiClient.config.NormalizeInput {
+		userInput = normalizeInput(userInput)
+	}
+
+	if session.countNext {
+		session.countNext = false
+		printTokenCount(userInput, session)
+		return nil
+	}
+
+	userInput, ok := enforceInputLimit(ctx, session, userInput)
+	if !ok {
+		return nil
+	}
+
+	userInput, maxTokens, err := parseMaxTokensDirective(userInput, session.apiClient)
+	if err != nil {
+		fmt.Fprintf(session.out, "%s%v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	if maxTokens > 0 {
+		previous := session.apiClient.maxTokens
+		session.apiClient.maxTokens = maxTokens
+		defer func() { session.apiClient.maxTokens = previous }()
+	}
+
+	if len(session.pendingPages) > 0 {
+		userInput = strings.Join(session.pendingPages, "\n\n") + "\n\n" + userInput
+		session.pendingPages = nil
+	}
+	if session.pendingPrompt != "" {
+		userInput = session.pendingPrompt + "\n\n" + userInput
+		session.pendingPrompt = ""
+	}
+
+	if !confirmLargeRequest(ctx, session, userInput) || !session.withinCostLimit(ctx) {
+		return nil
+	}
+
+	if session.apiClient.config.EchoSentInput {
+		fmt.Fprintf(session.out, "%sSent: %s%s\n", colorDim, userInput, colorReset)
+	}
+
+	session.conversation.addMessage("user", userInput)
+	if len(session.pendingImages) > 0 {
+		session.conversation.attachImages(session.pendingImages)
+		session.pendingImages = nil
+	}
+	if len(session.pendingContext) > 0 {
+		session.apiClient.ephemeral = session.pendingContext
+		session.pendingContext = nil
+		defer func() { session.apiClient.ephemeral = nil }()
+	}
+	return session.respond(ctx)
+}
+
+func (s *ChatSession) respond(ctx context.Context) error {
+	start := time.Now()
+	spinner, onDelta := s.startResponseStatus(start)
+	aiResponse, err := getAIResponseWithRetry(ctx, s.apiClient, s.conversation, onDelta)
+	spinner.Stop()
+	if errors.Is(err, errLoopDetected) {
+		return s.handleLoopDetected(ctx)
+	}
+	var partial *PartialResponseError
+	if errors.As(err, &partial) && ctx.Err() == nil && s.keepPartial(ctx, partial) {
+		aiResponse, err = partial.Partial, nil
+	}
+	if err != nil {
+		if !s.apiClient.config.continueOnError() {
+			return fmt.Errorf("failed to get AI response: %w", err)
+		}
+		fmt.Fprintf(s.out, "%sFailed to get AI response: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	if strings.TrimSpace(aiResponse.Content) == "" {
+		return s.handleEmptyResponse(ctx)
+	}
+	aiResponse.Content = s.apiClient.withPrefill(aiResponse.Content)
+	if s.apiClient.jsonMode && !json.Valid([]byte(aiResponse.Content)) {
+		fmt.Fprintf(s.out, "%sWarning: JSON mode is on but the response is not valid JSON.%s\n", colorYellow, colorReset)
+	}
+
+	if s.showReasoning && aiResponse.Reasoning != "" {
+		printReasoning(s.out, aiResponse.Reasoning)
+	}
+
+	s.printResponse(ctx, aiResponse.Content)
+	s.conversation.addMessage("assistant", aiResponse.Content)
+
+	if s.responseLog != nil {
+		if err := s.responseLog.log(s.conversation.lastUserMessage(), aiResponse, time.Since(start)); err != nil {
+			fmt.Fprintf(s.out, "%sError writing response log: %v%s\n", colorRed, err, colorReset)
+		}
+	}
+
+	s.endTurn()
+	return nil
+}
+
+func (s *ChatSession) startResponseStatus(start time.Time) (*Spinner, func(StreamChannel, string)) {
+	if !s.apiClient.config.ShowStreamStats {
+		spinner := startSpinner(s, s.apiClient.config.ThinkingText)
+		return spinner, func(StreamChannel, string) { spinner.Stop() }
+	}
+	stats := &streamStats{start: start}
+	spinner := startStatusLine(s, stats.status(s.apiClient.config.ThinkingText))
+	return spinner, func(_ StreamChannel, text string) { stats.add(text) }
+}
+
+func (s *ChatSession) endTurn() {
+	fmt.Fprint(s.out, strings.Repeat("\n", s.apiClient.config.TurnSpacing))
+}
+
+func (s *ChatSession) handleEmptyResponse(ctx context.Context) error {
+	if s.apiClient.config.EmptyResponse == "retry" && !s.retryingEmpty {
+		fmt.Fprintf(s.out, "%sThe model returned an empty response. Regenerating once...%s\n", colorYellow, colorReset)
+		s.retryingEmpty = true
+		defer func() { s.retryingEmpty = false }()
+		return s.respond(ctx)
+	}
+
+	s.conversation.removeTrailingUserMessage()
+	fmt.Fprintf(s.out, "%sThe model returned an empty response; your message was removed from the history.%s\n", colorYellow, colorReset)
+	return nil
+}
+
+func (s *ChatSession) keepPartial(ctx context.Context, partial *PartialResponseError) bool {
+	fmt.Fprintf(s.out, "%sThe response was cut off: %v%s\n", colorYellow, partial.Err, colorReset)
+	if s.input == nil || !s.terminal.Interactive {
+		return s.apiClient.config.KeepPartialReplies
+	}
+
+	fmt.Fprintf(s.out, "%sKeep the partial response (%d characters) in the history? [y/N]%s ", colorYellow, len(partial.Partial.Content), colorReset)
+	answer, err := s.input.readLine(ctx, 0)
+	return err == nil && strings.EqualFold(answer, "y")
+}
+
+func handleCommand(ctx context.Context, userInput string, session *ChatSession) (bool, error) {
+	command, _, _ := strings.Cut(userInput, " ")
+	switch command {
+	case "/help":
+		return true, handleHelpCommand(session)
+	case "/save":
+		return true, handleSaveCommand(userInput, session)
+	case "/save-md":
+		return true, handleSaveMarkdownCommand(userInput, session)
+	case "/export-html":
+		return true, handleExportHTMLCommand(userInput, session)
+	case "/template":
+		return true, handleTemplateCommand(userInput, session)
+	case "/load":
+		return true, handleLoadCommand(userInput, session)
+	case "/verbose":
+		return true, handleVerboseCommand(userInput, session)
+	case "/think":
+		return true, handleThinkCommand(session)
+	case "/models":
+		return true, handleModelsCommand(ctx, session)
+	case "/model":
+		return true, handleModelCommand(userInput, session)
+	case "/prompt":
+		return true, handlePromptCommand(userInput, session)
+	case "/compare":
+		return true, handleCompareCommand(ctx, userInput, session)
+	case "/replay":
+		return true, handleReplayCommand(ctx, session)
+	case "/branch":
+		return true, handleBranchCommand(userInput, session)
+	case "/switch":
+		return true, handleSwitchCommand(userInput, session)
+	case "/branches":
+		return true, handleBranchesCommand(session)
+	case "/wrap":
+		return true, handleWrapCommand(userInput, session)
+	case "/cost":
+		return true, handleCostCommand(session)
+	case "/cls", "/clear-screen":
+		return true, handleClearScreenCommand(session)
+	case "/clear":
+		return true, handleClearCommand(session)
+	case "/config":
+		return true, handleConfigCommand(session)
+	case "/list":
+		return true, handleListCommand(session)
+	case "/count":
+		return true, handleCountCommand(userInput, session)
+	case "/last":
+		return true, handleLastCommand(ctx, userInput, session)
+	case "/history":
+		return true, handleHistoryCommand(userInput, session)
+	case "/queue":
+		return true, handleQueueCommand(session)
+	case "/run":
+		return true, handleRunCommand(ctx, session)
+	case "/showqueue":
+		return true, handleShowQueueCommand(session)
+	case "/clearqueue":
+		return true, handleClearQueueCommand(session)
+	case "/window":
+		return true, handleWindowCommand(ctx, userInput, session)
+	case "/maxtokens":
+		return true, handleMaxTokensCommand(userInput, session)
+	case "/preset":
+		return true, handlePresetCommand(userInput, session)
+	case "/with":
+		return true, handleWithCommand(ctx, userInput, session)
+	case "/url":
+		return true, handleURLCommand(ctx, userInput, session)
+	case "/image":
+		return true, handleImageCommand(userInput, session)
+	case "/roles":
+		return true, handleRolesCommand(userInput, session)
+	case "/prefill":
+		return true, handlePrefillCommand(userInput, session)
+	case "/rename":
+		return true, handleRenameCommand(userInput, session)
+	case "/json":
+		return true, handleJSONCommand(session)
+	case "/profile":
+		return true, handleProfileCommand(userInput, session)
+	case "/pin":
+		return true, handlePinCommand(userInput, session, true)
+	case "/unpin":
+		return true, handlePinCommand(userInput, session, false)
+	default:
+		return false, nil
+	}
+}
+
+func enforceInputLimit(ctx context.Context, session *ChatSession, userInput string) (string, bool) {
+	limit := session.apiClient.config.MaxUserInputChars
+	length := utf8.RuneCountInString(userInput)
+	if limit == 0 || length <= limit {
+		return userInput, true
+	}
+
+	if !session.terminal.Interactive {
+		fmt.Fprintf(session.out, "%sMessage is %d characters, exceeding the limit of %d. Message discarded.%s\n", colorYellow, length, limit, colorReset)
+		return "", false
+	}
+
+	fmt.Fprintf(session.out, "%sMessage is %d characters, exceeding the limit of %d. Truncate and send? [y/N]%s ", colorYellow, length, limit, colorReset)
+	answer, err := session.input.readLine(ctx, 0)
+	if err != nil || !strings.EqualFold(answer, "y") {
+		fmt.Fprintf(session.out, "%sMessage discarded.%s\n", colorYellow, colorReset)
+		return "", false
+	}
+
+	return string([]rune(userInput)[:limit]), true
+}
+
+func confirmLargeRequest(ctx context.Context, session *ChatSession, userInput string) bool {
+	apiClient := session.apiClient
+	threshold := apiClient.config.ConfirmAboveTokens
+	if threshold == 0 {
+		return true
+	}
+
+	tokens := countTokens(apiClient.requestHistory(session.conversation, apiClient.model)) + len(strings.Fields(userInput))
+	if tokens <= threshold {
+		return true
+	}
+
+	if !session.terminal.Interactive {
+		log.Printf("Sending a request of ~%d tokens without confirmation (stdin is not a terminal)", tokens)
+		return true
+	}
+
+	estimate := ""
+	if pricing, ok := apiClient.config.Pricing[apiClient.model]; ok {
+		estimate = fmt.Sprintf(" (~$%.4f)", pricing.cost(UsageTotals{PromptTokens: tokens}))
+	}
+	fmt.Fprintf(session.out, "%sThis request is ~%d tokens%s. Send? [y/N]%s ", colorYellow, tokens, estimate, colorReset)
+	answer, err := session.input.readLine(ctx, 0)
+	if err != nil || !strings.EqualFold(answer, "y") {
+		fmt.Fprintf(session.out, "%sMessage discarded.%s\n", colorYellow, colorReset)
+		return false
+	}
+	return true
+}
+
+func handleSaveCommand(userInput string, session *ChatSession) error {
+	target := strings.TrimSpace(strings.TrimPrefix(userInput, "/save"))
+	if target == "all" {
+		return handleSaveAllBranches(session)
+	}
+
+	if err := session.store.Save(target, session.conversation); err != nil {
+		fmt.Fprintf(session.out, "%sError saving conversation: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	session.conversation.markSaved()
+	return nil
+}
+
+func handleListCommand(session *ChatSession) error {
+	stored, err := session.store.List()
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError listing conversations: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	if len(stored) == 0 {
+		fmt.Fprintf(session.out, "%sNo saved conversations in %s.%s\n", colorYellow, session.store.Location(), colorReset)
+		return nil
+	}
+
+	fmt.Fprintf(session.out, "%sSaved conversations in %s:%s\n", colorCyan, session.store.Location(), colorReset)
+	for _, entry := range stored {
+		fmt.Fprintf(session.out, "  %s (%s, %s)\n", entry.Name, entry.SavedAt.Format("2006-01-02 15:04"), entry.Detail)
+	}
+	return nil
+}
+
+func handleLoadCommand(userInput string, session *ChatSession) error {
+	parts := strings.SplitN(userInput, " ", 2)
+	if len(parts) != 2 {
+		fmt.Fprintf(session.out, "%sUsage: /load <filename>%s\n", colorYellow, colorReset)
+		return nil
+	}
+	loadedConversation, err := session.store.Load(parts[1])
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError loading conversation: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	session.conversation.replaceWith(loadedConversation)
+	session.conversation.markSaved()
+	printConversationSummary(session.out, session.conversation, session.apiClient.config)
+	return nil
 }
 
-type Message struct {
-	Role      string    `json:"role"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"-"`
+func handleCountCommand(userInput string, session *ChatSession) error {
+	text := strings.TrimSpace(strings.TrimPrefix(userInput, "/count"))
+	if text == "" {
+		session.countNext = true
+		fmt.Fprintf(session.out, "%sYour next message will be counted, not sent.%s\n", colorYellow, colorReset)
+		return nil
+	}
+	printTokenCount(text, session)
+	return nil
 }
 
-type APIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
+func handleHistoryCommand(userInput string, session *ChatSession) error {
+	history := session.conversation.getHistory()
+	arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/history"))
+	count := len(history)
+	full := arg == "full"
+	if arg != "" && !full {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(session.out, "%sUsage: /history [n|full]%s\n", colorYellow, colorReset)
+			return nil
+		}
+		count = min(n, len(history))
+	}
 
-type Conversation struct {
-	History    []Message
-	mu         sync.RWMutex
-	tokenCount int
+	if len(history) == 0 {
+		fmt.Fprintf(session.out, "%sThe conversation is empty.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	config := session.apiClient.config
+	for i := len(history) - count; i < len(history); i++ {
+		msg := history[i]
+		roleColor := colorPurple
+		switch msg.Role {
+		case "user":
+			roleColor = colorGreen
+		case "system":
+			roleColor = colorYellow
+		}
+		pin := " "
+		if msg.Pinned {
+			pin = "*"
+		}
+		content := msg.Content
+		if !full {
+			content = truncateString(strings.ReplaceAll(content, "\n", " "), 80)
+		}
+		fmt.Fprintf(session.out, "%s%3d%s %s %s%s:%s %s\n", colorDim, i+1, colorReset, pin, roleColor, config.roleLabel(msg.Role), colorReset, content)
+	}
+	return nil
 }
 
-type APIClient struct {
-	httpClient  *http.Client
-	apiKey      string
-	rateLimiter *time.Ticker
+func handleLastCommand(ctx context.Context, userInput string, session *ChatSession) error {
+	count := 1
+	if arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/last")); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(session.out, "%sUsage: /last [n]%s\n", colorYellow, colorReset)
+			return nil
+		}
+		count = n
+	}
+
+	messages := session.conversation.lastAssistantMessages(count)
+	if len(messages) == 0 {
+		fmt.Fprintf(session.out, "%sNo responses yet.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	for _, content := range messages {
+		session.printResponse(ctx, content)
+		session.endTurn()
+	}
+	return nil
 }
 
-func main() {
-	if err := run(); err != nil {
-		log.Fatalf("%sError: %v%s\n", colorRed, err, colorReset)
+func handleWindowCommand(ctx context.Context, userInput string, session *ChatSession) error {
+	conversation := session.conversation
+	arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/window"))
+	if arg == "" {
+		fmt.Fprintf(session.out, "%sTruncation window: %d tokens (conversation is ~%d tokens).%s\n", colorYellow, conversation.getWindow(), countTokens(conversation.getHistory()), colorReset)
+		return nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		fmt.Fprintf(session.out, "%sUsage: /window [tokens]%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	if dropped := conversation.droppedByWindow(n); dropped > 0 {
+		if !session.terminal.Interactive {
+			fmt.Fprintf(session.out, "%sA window of %d tokens drops %d message(s) now. Window unchanged.%s\n", colorYellow, n, dropped, colorReset)
+			return nil
+		}
+		fmt.Fprintf(session.out, "%sA window of %d tokens drops %d message(s) now. Apply? [y/N]%s ", colorYellow, n, dropped, colorReset)
+		answer, err := session.input.readLine(ctx, 0)
+		if err != nil || !strings.EqualFold(answer, "y") {
+			fmt.Fprintf(session.out, "%sWindow unchanged.%s\n", colorYellow, colorReset)
+			return nil
+		}
 	}
+
+	conversation.setWindow(n)
+	fmt.Fprintf(session.out, "%sTruncation window set to %d tokens.%s\n", colorGreen, n, colorReset)
+	return nil
 }
 
-func run() error {
-	config, err := loadConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
+func handleMaxTokensCommand(userInput string, session *ChatSession) error {
+	apiClient := session.apiClient
+	arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/maxtokens"))
+	switch arg {
+	case "":
+		fmt.Fprintf(session.out, "%sMax output tokens: %d%s\n", colorCyan, apiClient.outputTokenLimit(apiClient.model), colorReset)
+		return nil
+	case "reset":
+		apiClient.maxTokens = 0
+		fmt.Fprintf(session.out, "%sMax output tokens reset to the model default.%s\n", colorGreen, colorReset)
+		return nil
 	}
 
-	apiClient := newAPIClient(config.GroqAPIKey)
-	conversation, err := newConversation()
+	n, err := strconv.Atoi(arg)
 	if err != nil {
-		return fmt.Errorf("failed to create conversation: %w", err)
+		fmt.Fprintf(session.out, "%sUsage: /maxtokens [n|reset]%s\n", colorYellow, colorReset)
+		return nil
+	}
+	if err := apiClient.validateMaxTokens(n); err != nil {
+		fmt.Fprintf(session.out, "%s%v%s\n", colorRed, err, colorReset)
+		return nil
 	}
 
-	printWelcomeMessage()
-	return runChatLoop(apiClient, conversation)
+	apiClient.maxTokens = n
+	fmt.Fprintf(session.out, "%sMax output tokens set to %d.%s\n", colorGreen, n, colorReset)
+	return nil
 }
 
-func loadConfig() (*Config, error) {
-	data, err := os.ReadFile(configFile)
+func parseMaxTokensDirective(userInput string, apiClient *APIClient) (string, int, error) {
+	if !strings.HasPrefix(userInput, maxTokensDirective) {
+		return userInput, 0, nil
+	}
+
+	directive, rest, _ := strings.Cut(userInput, " ")
+	n, err := strconv.Atoi(strings.TrimPrefix(directive, maxTokensDirective))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return "", 0, fmt.Errorf("invalid directive %q, expected %s<n>", directive, maxTokensDirective)
+	}
+	if err := apiClient.validateMaxTokens(n); err != nil {
+		return "", 0, err
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return "", 0, fmt.Errorf("%s needs a message after it", directive)
 	}
+	return rest, n, nil
+}
 
-	if config.GroqAPIKey == "" {
-		return nil, errors.New("GroqAPIKey is missing in the config file")
+func (c *APIClient) validateMaxTokens(n int) error {
+	profile := c.config.modelProfile(c.model)
+	if n <= 0 || n > profile.MaxOutputTokens {
+		return fmt.Errorf("max tokens must be between 1 and %d for %s, got %d", profile.MaxOutputTokens, c.model, n)
 	}
+	return nil
+}
 
-	return &config, nil
+func (c *APIClient) withPrefill(content string) string {
+	return strings.TrimSpace(c.prefill + content)
 }
 
-func newAPIClient(apiKey string) *APIClient {
-	return &APIClient{
-		httpClient: &http.Client{
-			Timeout: time.Second * timeoutSeconds,
-			Transport: &http.Transport{
-				TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
-				MaxIdleConns:        100,
-				MaxConnsPerHost:     100,
-				IdleConnTimeout:     90 * time.Second,
-				DisableCompression:  true,
-				ForceAttemptHTTP2:   true,
-				MaxIdleConnsPerHost: 100,
-			},
-		},
-		apiKey:      apiKey,
-		rateLimiter: time.NewTicker(time.Second / requestsPerSecond),
+func (c *APIClient) outputTokenLimit(model string) int {
+	limit := c.config.modelProfile(model).MaxOutputTokens
+	if c.maxTokens > 0 {
+		return min(c.maxTokens, limit)
 	}
+	return limit
 }
 
-func newConversation() (*Conversation, error) {
-	systemPrompt, err := loadSystemPrompt()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load system prompt: %w", err)
+func handleRolesCommand(userInput string, session *ChatSession) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/roles"))
+	switch arg {
+	case "":
+	case "fix":
+		merged := session.conversation.mergeAdjacentRoles()
+		fmt.Fprintf(session.out, "%sMerged %d adjacent same-role messages.%s\n", colorGreen, merged, colorReset)
+	default:
+		fmt.Fprintf(session.out, "%sUsage: /roles [fix]%s\n", colorYellow, colorReset)
+		return nil
 	}
 
-	return &Conversation{
-		History:    []Message{{Role: "system", Content: systemPrompt, Timestamp: time.Now()}},
-		tokenCount: len(strings.Fields(systemPrompt)),
-	}, nil
+	history := session.conversation.getHistory()
+	roles := make([]string, len(history))
+	issues := 0
+	for i, msg := range history {
+		roles[i] = msg.Role
+		switch {
+		case i > 0 && msg.Role == history[i-1].Role:
+			issues++
+			fmt.Fprintf(session.out, "%sMessage %d repeats the %s role of the message before it.%s\n", colorYellow, i+1, msg.Role, colorReset)
+		case msg.Role == "system" && i > 0:
+			issues++
+			fmt.Fprintf(session.out, "%sMessage %d is a system message after the start of the conversation.%s\n", colorYellow, i+1, colorReset)
+		}
+	}
+
+	fmt.Fprintf(session.out, "%sRoles:%s %s\n", colorCyan, colorReset, strings.Join(roles, " → "))
+	if issues == 0 {
+		fmt.Fprintf(session.out, "%sRoles alternate correctly.%s\n", colorGreen, colorReset)
+	} else if arg == "" {
+		fmt.Fprintf(session.out, "%sFound %d issue(s). Run /roles fix to merge adjacent same-role messages.%s\n", colorYellow, issues, colorReset)
+	}
+	return nil
+}
+
+func handleRenameCommand(userInput string, session *ChatSession) error {
+	title := strings.TrimSpace(strings.TrimPrefix(userInput, "/rename"))
+	if title == "" {
+		if current := session.conversation.getTitle(); current != "" {
+			fmt.Fprintf(session.out, "%sTitle: %s%s\n", colorCyan, current, colorReset)
+		} else {
+			fmt.Fprintf(session.out, "%sUsage: /rename <title>%s\n", colorYellow, colorReset)
+		}
+		return nil
+	}
+
+	session.conversation.setTitle(title)
+	fmt.Fprintf(session.out, "%sSession renamed to %q.%s\n", colorGreen, title, colorReset)
+	return nil
+}
+
+func handleJSONCommand(session *ChatSession) error {
+	apiClient := session.apiClient
+	apiClient.jsonMode = !apiClient.jsonMode
+	state := "off"
+	if apiClient.jsonMode {
+		state = "on"
+	}
+	fmt.Fprintf(session.out, "%sJSON mode turned %s.%s\n", colorYellow, state, colorReset)
+	return nil
 }
 
-func loadSystemPrompt() (string, error) {
-	data, err := os.ReadFile(systemPromptFile)
+func handlePinCommand(userInput string, session *ChatSession, pinned bool) error {
+	command, arg, _ := strings.Cut(userInput, " ")
+	index, err := strconv.Atoi(strings.TrimSpace(arg))
 	if err != nil {
-		return "", fmt.Errorf("failed to read system prompt file: %w", err)
+		fmt.Fprintf(session.out, "%sUsage: %s <index>%s\n", colorYellow, command, colorReset)
+		return nil
+	}
+
+	if err := session.conversation.setPinned(index-1, pinned); err != nil {
+		fmt.Fprintf(session.out, "%s%v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+
+	if pinned {
+		fmt.Fprintf(session.out, "%sPinned message %d.%s\n", colorGreen, index, colorReset)
+	} else {
+		fmt.Fprintf(session.out, "%sUnpinned message %d.%s\n", colorGreen, index, colorReset)
 	}
-	return string(data), nil
+	return nil
 }
 
-func printWelcomeMessage() {
-	clearScreen()
-	width, _, _ := term.GetSize(int(os.Stdout.Fd()))
-	welcomeMsg := "Welcome to the AI Chat!"
-	border := strings.Repeat("─", width-4)
+func printTokenCount(text string, session *ChatSession) {
+	apiClient := session.apiClient
+	tokens := len(strings.Fields(text))
+	profile := apiClient.config.modelProfile(apiClient.model)
+	share := float64(tokens) / float64(profile.ContextWindow) * 100
+	fmt.Fprintf(session.out, "%s~%d tokens (%.1f%% of the %d-token context window of %s)%s\n",
+		colorCyan, tokens, share, profile.ContextWindow, apiClient.model, colorReset)
+}
 
-	fmt.Printf("%s┌%s┐\n", colorCyan, border)
-	fmt.Printf("│%s%s%s│\n", strings.Repeat(" ", (width-len(welcomeMsg)-2)/2), welcomeMsg, strings.Repeat(" ", (width-len(welcomeMsg)-1)/2))
-	fmt.Printf("└%s┘%s\n", border, colorReset)
-	fmt.Printf("%sType '%s' to exit the program.%s\n\n", colorBlue, exitCommand, colorReset)
+func handleClearScreenCommand(session *ChatSession) error {
+	if !session.terminal.SupportsANSI {
+		fmt.Fprintf(session.out, "%sThis terminal does not support clearing the screen.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	clearScreen(session.out)
+	fmt.Fprintf(session.out, "%sAI Chat — %s, %d messages in history%s\n\n", colorCyan, session.apiClient.model, len(session.conversation.getHistory()), colorReset)
+	return nil
 }
 
-func runChatLoop(apiClient *APIClient, conversation *Conversation) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func handleConfigCommand(session *ChatSession) error {
+	config := redactedConfig(session.apiClient.config)
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError rendering config: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	profile := config.modelProfile(session.apiClient.model)
+	fmt.Fprintf(session.out, "%sEffective configuration:%s\n", colorCyan, colorReset)
+	fmt.Fprintf(session.out, "active model: %s\n", session.apiClient.model)
+	fmt.Fprintf(session.out, "base url: %s\n", session.apiClient.baseURL)
+	fmt.Fprintf(session.out, "context window: %d\n", profile.ContextWindow)
+	fmt.Fprintf(session.out, "max output tokens: %d\n", profile.MaxOutputTokens)
+	fmt.Fprintf(session.out, "max conversation tokens: %d\n", session.conversation.getWindow())
+	fmt.Fprintf(session.out, "wrap width: %d\n", session.wrapColumn())
+	fmt.Fprint(session.out, string(data))
+	return nil
+}
 
-	g.Go(func() error {
-		return handleInterrupt(ctx)
-	})
+func redactedConfig(c *Config) Config {
+	config := *c
+	config.GroqAPIKey = redactAPIKey(config.GroqAPIKey)
+	profiles := make(map[string]ProviderProfile, len(config.Profiles))
+	for name, profile := range config.Profiles {
+		profile.APIKey = redactAPIKey(profile.APIKey)
+		profiles[name] = profile
+	}
+	config.Profiles = profiles
+	headers := make(map[string]string, len(config.ExtraHeaders))
+	for name, value := range config.ExtraHeaders {
+		headers[name] = redactAPIKey(value)
+	}
+	config.ExtraHeaders = headers
+	return config
+}
 
-	g.Go(func() error {
-		return processChatInputLoop(ctx, apiClient, conversation)
-	})
+func redactAPIKey(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return apiKey[:4] + strings.Repeat("*", len(apiKey)-8) + apiKey[len(apiKey)-4:]
+}
 
-	return g.Wait()
+func handleClearCommand(session *ChatSession) error {
+	session.conversation.clear()
+	session.apiClient.usage.reset()
+	fmt.Fprintf(session.out, "%sConversation cleared.%s\n", colorYellow, colorReset)
+	return nil
 }
 
-func handleInterrupt(ctx context.Context) error {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+func handleWrapCommand(userInput string, session *ChatSession) error {
+	parts := strings.Fields(userInput)
+	if len(parts) != 2 {
+		fmt.Fprintf(session.out, "%sUsage: /wrap <columns|0|off>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	if parts[1] == "off" {
+		session.wrapWidth = wrapTerminalWidth
+		fmt.Fprintf(session.out, "%sWrapping at terminal width.%s\n", colorYellow, colorReset)
+		return nil
+	}
 
-	select {
-	case <-sigChan:
-		fmt.Printf("\n%sReceived interrupt signal. Exiting...%s\n", colorYellow, colorReset)
+	width, err := strconv.Atoi(parts[1])
+	if err != nil || width < 0 {
+		fmt.Fprintf(session.out, "%sInvalid wrap width %q.%s\n", colorRed, parts[1], colorReset)
 		return nil
-	case <-ctx.Done():
-		return ctx.Err()
 	}
+
+	session.wrapWidth = width
+	if width == 0 {
+		fmt.Fprintf(session.out, "%sWrapping disabled.%s\n", colorYellow, colorReset)
+	} else {
+		fmt.Fprintf(session.out, "%sWrapping at %d columns.%s\n", colorYellow, width, colorReset)
+	}
+	return nil
 }
 
-func processChatInputLoop(ctx context.Context, apiClient *APIClient, conversation *Conversation) error {
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			if err := processChatInput(ctx, scanner, apiClient, conversation); err != nil {
-				if errors.Is(err, io.EOF) {
-					return nil
-				}
-				return err
-			}
-		}
+func (s *ChatSession) wrapColumn() int {
+	if s.wrapWidth != wrapTerminalWidth {
+		return s.wrapWidth
+	}
+	if !s.terminal.IsTTY {
+		return 0
 	}
+	return s.terminal.Width
 }
 
-func processChatInput(ctx context.Context, scanner *bufio.Scanner, apiClient *APIClient, conversation *Conversation) error {
-	userInput := getUserInput(scanner)
-	if userInput == "" {
+func handleVerboseCommand(userInput string, session *ChatSession) error {
+	switch strings.TrimSpace(strings.TrimPrefix(userInput, "/verbose")) {
+	case "on":
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	case "off":
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	case "":
+	default:
+		fmt.Fprintf(session.out, "%sUsage: /verbose [on|off]%s\n", colorYellow, colorReset)
 		return nil
 	}
-	if strings.EqualFold(userInput, exitCommand) {
-		fmt.Printf("%sGoodbye!%s\n", colorYellow, colorReset)
-		return io.EOF
+
+	level := slog.LevelInfo
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		level = slog.LevelDebug
+	}
+	fmt.Fprintf(session.out, "%sLog level: %s%s\n", colorYellow, level, colorReset)
+	return nil
+}
+
+func handleThinkCommand(session *ChatSession) error {
+	session.showReasoning = !session.showReasoning
+	state := "off"
+	if session.showReasoning {
+		state = "on"
 	}
+	fmt.Fprintf(session.out, "%sReasoning display turned %s.%s\n", colorYellow, state, colorReset)
+	return nil
+}
 
-	if strings.HasPrefix(userInput, "/save") {
-		return handleSaveCommand(conversation)
+func handleModelCommand(userInput string, session *ChatSession) error {
+	apiClient := session.apiClient
+	parts := strings.Fields(userInput)
+	if len(parts) > 2 {
+		fmt.Fprintf(session.out, "%sUsage: /model [name]%s\n", colorYellow, colorReset)
+		return nil
 	}
+	if len(parts) == 2 {
+		apiClient.model = parts[1]
+	}
+
+	profile := apiClient.config.modelProfile(apiClient.model)
+	fmt.Fprintf(session.out, "%sModel: %s (context window %d, max output %d tokens)%s\n",
+		colorCyan, apiClient.model, profile.ContextWindow, profile.MaxOutputTokens, colorReset)
+	return nil
+}
 
-	if strings.HasPrefix(userInput, "/load") {
-		return handleLoadCommand(userInput, conversation)
+func handleProfileCommand(userInput string, session *ChatSession) error {
+	apiClient := session.apiClient
+	parts := strings.Fields(userInput)
+	if len(parts) > 2 {
+		fmt.Fprintf(session.out, "%sUsage: /profile [name]%s\n", colorYellow, colorReset)
+		return nil
 	}
 
-	conversation.addMessage("user", userInput)
+	if len(parts) == 1 {
+		names := make([]string, 0, len(apiClient.config.Profiles))
+		for name := range apiClient.config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		current := apiClient.config.Profile
+		if current == "" {
+			current = "(none)"
+		}
+		fmt.Fprintf(session.out, "%sProfile: %s (%s, %s)%s\n", colorCyan, current, apiClient.baseURL, apiClient.model, colorReset)
+		if len(names) > 0 {
+			fmt.Fprintf(session.out, "Available: %s\n", strings.Join(names, ", "))
+		}
+		return nil
+	}
 
-	aiResponse, err := getAIResponseWithRetry(ctx, apiClient, conversation)
+	candidate := *apiClient.config
+	err := candidate.applyProfile(parts[1])
+	if err == nil {
+		err = candidate.resolveAPIKey()
+	}
+	if err == nil {
+		err = validateBaseURL(candidate.BaseURL)
+	}
 	if err != nil {
-		fmt.Printf("%sFailed to get AI response: %v%s\n", colorRed, err, colorReset)
+		fmt.Fprintf(session.out, "%sCannot switch profile: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	candidate.BaseURL = strings.TrimRight(candidate.BaseURL, "/")
+
+	*apiClient.config = candidate
+	apiClient.baseURL = candidate.BaseURL
+	apiClient.apiKey = candidate.GroqAPIKey
+	apiClient.model = candidate.Model
+	apiClient.modelsCache.reset()
+	fmt.Fprintf(session.out, "%sSwitched to profile %s (%s, %s).%s\n", colorGreen, parts[1], apiClient.baseURL, apiClient.model, colorReset)
+	return nil
+}
+
+func handlePresetCommand(userInput string, session *ChatSession) error {
+	apiClient := session.apiClient
+	parts := strings.Fields(userInput)
+	if len(parts) > 2 {
+		fmt.Fprintf(session.out, "%sUsage: /preset [name]%s\n", colorYellow, colorReset)
 		return nil
 	}
 
-	fmt.Printf("%sAI:%s ", colorPurple, colorReset)
-	printStreamingResponse(aiResponse)
-	conversation.addMessage("assistant", aiResponse)
+	if len(parts) == 2 {
+		if _, ok := apiClient.config.samplingPreset(parts[1]); !ok {
+			fmt.Fprintf(session.out, "%sUnknown preset %q. Available: %s%s\n", colorRed, parts[1], strings.Join(apiClient.config.samplingPresetNames(), ", "), colorReset)
+			return nil
+		}
+		apiClient.preset = parts[1]
+	}
 
-	fmt.Println()
+	preset, _ := apiClient.config.samplingPreset(apiClient.preset)
+	fmt.Fprintf(session.out, "%sPreset: %s (temperature %.2f, top_p %.2f)%s\n", colorCyan, apiClient.preset, preset.Temperature, preset.TopP, colorReset)
 	return nil
 }
 
-func handleSaveCommand(conversation *Conversation) error {
-	if err := saveConversation(conversation); err != nil {
-		fmt.Printf("%sError saving conversation: %v%s\n", colorRed, err, colorReset)
+func handlePrefillCommand(userInput string, session *ChatSession) error {
+	apiClient := session.apiClient
+	text := strings.TrimPrefix(strings.TrimPrefix(userInput, "/prefill"), " ")
+	switch text {
+	case "":
+		if apiClient.prefill == "" {
+			fmt.Fprintf(session.out, "%sNo prefill set.%s\n", colorCyan, colorReset)
+		} else {
+			fmt.Fprintf(session.out, "%sPrefill: %q%s\n", colorCyan, apiClient.prefill, colorReset)
+		}
+	case "clear":
+		apiClient.prefill = ""
+		fmt.Fprintf(session.out, "%sPrefill cleared.%s\n", colorGreen, colorReset)
+	default:
+		apiClient.prefill = text
+		fmt.Fprintf(session.out, "%sResponses will continue from %q.%s\n", colorGreen, text, colorReset)
 	}
 	return nil
 }
 
-func handleLoadCommand(userInput string, conversation *Conversation) error {
-	parts := strings.SplitN(userInput, " ", 2)
+func handlePromptCommand(userInput string, session *ChatSession) error {
+	prompts := session.apiClient.config.Prompts
+	parts := strings.Fields(userInput)
+	if len(parts) == 1 {
+		if len(prompts) == 0 {
+			fmt.Fprintf(session.out, "%sNo prompts defined in the config file.%s\n", colorYellow, colorReset)
+			return nil
+		}
+		names := make([]string, 0, len(prompts))
+		for name := range prompts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(session.out, "%sAvailable prompts:%s\n", colorCyan, colorReset)
+		for _, name := range names {
+			fmt.Fprintf(session.out, "  %s: %s\n", name, truncateString(prompts[name], 50))
+		}
+		return nil
+	}
+
 	if len(parts) != 2 {
-		fmt.Printf("%sUsage: /load <filename>%s\n", colorYellow, colorReset)
+		fmt.Fprintf(session.out, "%sUsage: /prompt [name]%s\n", colorYellow, colorReset)
 		return nil
 	}
-	loadedConversation, err := loadConversation(parts[1])
-	if err != nil {
-		fmt.Printf("%sError loading conversation: %v%s\n", colorRed, err, colorReset)
+
+	snippet, ok := prompts[parts[1]]
+	if !ok {
+		fmt.Fprintf(session.out, "%sUnknown prompt %q.%s\n", colorRed, parts[1], colorReset)
 		return nil
 	}
-	conversation.replaceWith(loadedConversation)
-	printConversationSummary(conversation)
+	session.pendingPrompt = snippet
+	fmt.Fprintf(session.out, "%sPrompt %q will be prepended to your next message.%s\n", colorYellow, parts[1], colorReset)
+	return nil
+}
+
+func handleReplayCommand(ctx context.Context, session *ChatSession) error {
+	history := session.conversation.getHistory()
+	session.runInterruptible(ctx, func(ctx context.Context) {
+		for _, msg := range history {
+			if msg.Role == "system" {
+				continue
+			}
+			if ctx.Err() != nil {
+				break
+			}
+
+			column := session.printLabel(msg.Role)
+			session.printStreamingResponse(ctx, msg.Content, column)
+			if msg.Role == "assistant" {
+				session.endTurn()
+			}
+
+			select {
+			case <-time.After(session.apiClient.config.ReplayDelay):
+			case <-ctx.Done():
+			}
+		}
+
+		if ctx.Err() != nil {
+			fmt.Fprintf(session.out, "\n%sReplay aborted.%s\n", colorYellow, colorReset)
+		}
+	})
 	return nil
 }
 
-func getAIResponseWithRetry(ctx context.Context, apiClient *APIClient, conversation *Conversation) (string, error) {
+func getAIResponseWithRetry(ctx context.Context, apiClient *APIClient, conversation *Conversation, onDelta func(StreamChannel, string)) (AIResponse, error) {
+	aiResponse, err := getAIResponseFromModel(ctx, apiClient, conversation, apiClient.model, maxRetries, onDelta)
+	var partial *PartialResponseError
+	if err == nil || ctx.Err() != nil || errors.Is(err, errLoopDetected) || errors.As(err, &partial) {
+		return aiResponse, err
+	}
+
+	failedModel := apiClient.model
+	for _, fallback := range apiClient.config.FallbackModels {
+		log.Printf("%s failed, falling back to %s", failedModel, fallback)
+		aiResponse, fallbackErr := getAIResponseFromModel(ctx, apiClient, conversation, fallback, 1, onDelta)
+		if fallbackErr == nil {
+			return aiResponse, nil
+		}
+		if ctx.Err() != nil {
+			return AIResponse{}, fallbackErr
+		}
+		failedModel = fallback
+	}
+
+	return AIResponse{}, err
+}
+
+func getAIResponseFromModel(ctx context.Context, apiClient *APIClient, conversation *Conversation, model string, attempts int, onDelta func(StreamChannel, string)) (AIResponse, error) {
 	var (
-		aiResponse string
-		err        error
-		backoff    = initialBackoff
+		aiResponse       AIResponse
+		err              error
+		backoff          = initialBackoff
+		transientRetried bool
 	)
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	for attempt := 0; attempt < attempts; attempt++ {
 		select {
 		case <-apiClient.rateLimiter.C:
 		case <-ctx.Done():
-			return "", ctx.Err()
+			return AIResponse{}, ctx.Err()
 		}
 
-		aiResponse, err = getAIResponse(ctx, apiClient, conversation)
+		apiClient.events.OnRequest(model, attempt+1)
+		start := time.Now()
+		aiResponse, err = getAIResponse(ctx, apiClient, conversation, model, onDelta)
+		finish := func(aiResponse *AIResponse) {
+			aiResponse.Model = model
+			apiClient.usage.record(model, aiResponse.Usage, countTokens(apiClient.requestHistory(conversation, model)), len(strings.Fields(aiResponse.Content)))
+		}
 		if err == nil {
+			finish(&aiResponse)
+			apiClient.events.OnResponse(model, time.Since(start), aiResponse.Usage)
 			return aiResponse, nil
 		}
+		apiClient.events.OnError(model, err)
+		var partial *PartialResponseError
+		if errors.As(err, &partial) {
+			finish(&partial.Partial)
+			return AIResponse{}, err
+		}
+		if errors.Is(err, errLoopDetected) {
+			return AIResponse{}, err
+		}
+
+		if !transientRetried && isTransientNetworkError(err) {
+			transientRetried = true
+			log.Printf("Attempt %d/%d hit a transient connection error, retrying immediately: %v", attempt+1, attempts, err)
+			attempt--
+			continue
+		}
 
-		log.Printf("Attempt %d failed: %v", attempt+1, err)
+		log.Printf("Attempt %d/%d failed (status %s): %v", attempt+1, attempts, statusOf(err), err)
 
-		if attempt < maxRetries-1 {
-			jitter := time.Duration(rand.Int63n(int64(backoff)))
-			sleepTime := backoff + jitter
-			log.Printf("Retrying in %v", sleepTime)
-			time.Sleep(sleepTime)
+		if attempt < attempts-1 {
+			sleepTime := retryDelay(apiClient.config.RetryJitter, backoff, apiClient.int63n)
+			log.Printf("Retrying in %v (backoff %v, %s jitter, %d attempts left)", sleepTime, backoff, apiClient.config.RetryJitter, attempts-attempt-1)
+			select {
+			case <-time.After(sleepTime):
+			case <-ctx.Done():
+				return AIResponse{}, ctx.Err()
+			}
 			backoff *= time.Duration(backoffFactor)
 		}
 	}
 
-	return "", fmt.Errorf("failed after %d attempts, last error: %w", maxRetries, err)
+	return AIResponse{}, fmt.Errorf("failed after %d attempts, last error: %w", attempts, err)
+}
+
+func retryDelay(strategy string, backoff time.Duration, int63n func(int64) int64) time.Duration {
+	switch strategy {
+	case "full":
+		return time.Duration(int63n(int64(backoff)))
+	case "none":
+		return backoff
+	default:
+		half := backoff / 2
+		return half + time.Duration(int63n(int64(half)))
+	}
+}
+
+func isTransientNetworkError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return strings.Contains(err.Error(), "GOAWAY")
+}
+
+func getUserInput(ctx context.Context, session *ChatSession) (string, error) {
+	session.printLabel("user")
+	return session.input.readLine(ctx, session.apiClient.config.IdleTimeout)
 }
 
-func getUserInput(scanner *bufio.Scanner) string {
-	fmt.Printf("%sYou:%s ", colorGreen, colorReset)
-	if !scanner.Scan() {
-		return exitCommand
+func (s *ChatSession) printLabel(role string) int {
+	labelColor := colorPurple
+	if role == "user" {
+		labelColor = colorGreen
 	}
-	return strings.TrimSpace(scanner.Text())
+	label := s.apiClient.config.roleLabel(role)
+	fmt.Fprintf(s.out, "%s%s:%s ", labelColor, label, colorReset)
+	return utf8.RuneCountInString(label) + 2
+}
+
+func handleIdleTimeout(session *ChatSession) error {
+	fmt.Fprintf(session.out, "\n%sNo input for %v, ending session.%s\n", colorYellow, session.apiClient.config.IdleTimeout, colorReset)
+	session.autosaveOnExit = true
+	return io.EOF
 }
 
 func (c *Conversation) addMessage(role, content string) {
@@ -308,14 +2283,93 @@ func (c *Conversation) addMessage(role, content string) {
 	tokens := len(strings.Fields(content))
 	c.tokenCount += tokens
 	c.History = append(c.History, Message{Role: role, Content: content, Timestamp: time.Now()})
-	c.truncateHistory()
+	c.dirty = true
+	if !c.keepFullHistory {
+		c.truncateHistory()
+	}
+	c.enforceMessageCap()
 }
 
 func (c *Conversation) truncateHistory() {
-	for c.tokenCount > maxConversationTokens && len(c.History) > 1 {
-		removedTokens := len(strings.Fields(c.History[1].Content))
+	for c.tokenCount > c.window() && len(c.History) > 2 {
+		index := c.firstUnpinned(1)
+		if index < 0 || index == len(c.History)-1 {
+			return
+		}
+		removedTokens := len(strings.Fields(c.History[index].Content))
 		c.tokenCount -= removedTokens
-		c.History = c.History[2:]
+		c.History = append(c.History[:index], c.History[index+1:]...)
+	}
+}
+
+func (c *Conversation) window() int {
+	if c.maxTokens > 0 {
+		return c.maxTokens
+	}
+	return maxConversationTokens
+}
+
+func (c *Conversation) getWindow() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.window()
+}
+
+func (c *Conversation) droppedByWindow(maxTokens int) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.keepFullHistory {
+		return 0
+	}
+	trial := &Conversation{History: append([]Message(nil), c.History...), tokenCount: c.tokenCount, maxTokens: maxTokens}
+	trial.truncateHistory()
+	return len(c.History) - len(trial.History)
+}
+
+func (c *Conversation) setWindow(maxTokens int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxTokens = maxTokens
+	if !c.keepFullHistory {
+		before := len(c.History)
+		c.truncateHistory()
+		c.dirty = c.dirty || len(c.History) != before
+	}
+}
+
+func (c *Conversation) firstUnpinned(start int) int {
+	for i := start; i < len(c.History); i++ {
+		if !c.History[i].Pinned {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Conversation) enforceMessageCap() {
+	if c.maxHistoryMessages <= 0 {
+		return
+	}
+
+	start := 0
+	if len(c.History) > 0 && c.History[0].Role == "system" {
+		start = 1
+	}
+
+	for len(c.History)-start > c.maxHistoryMessages {
+		index := c.firstUnpinned(start)
+		if index < 0 || index == len(c.History)-1 {
+			return
+		}
+		drop := 1
+		next := c.History[index+1]
+		if c.History[index].Role == "user" && next.Role == "assistant" && !next.Pinned && index+2 < len(c.History) {
+			drop = 2
+		}
+		for _, msg := range c.History[index : index+drop] {
+			c.tokenCount -= len(strings.Fields(msg.Content))
+		}
+		c.History = append(c.History[:index], c.History[index+drop:]...)
 	}
 }
 
@@ -325,197 +2379,622 @@ func (c *Conversation) getHistory() []Message {
 	return append([]Message(nil), c.History...)
 }
 
-func getAIResponse(ctx context.Context, apiClient *APIClient, conversation *Conversation) (string, error) {
+func statusOf(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return strconv.Itoa(apiErr.StatusCode)
+	}
+	return "n/a"
+}
+
+func getAIResponse(ctx context.Context, apiClient *APIClient, conversation *Conversation, model string, onDelta func(StreamChannel, string)) (AIResponse, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
 
-	response, err := apiClient.sendRequest(ctx, conversation)
+	requestID := newRequestID()
+	slog.Debug("sending request", "model", model, "request_id", requestID)
+	response, err := apiClient.sendRequest(ctx, conversation, model, requestID)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return AIResponse{}, fmt.Errorf("failed to send request %s: %w", requestID, err)
 	}
 	defer response.Body.Close()
 
+	providerID := response.Header.Get("X-Request-Id")
+	slog.Debug("received response", "status", response.StatusCode, "request_id", requestID, "provider_request_id", providerID)
 	if response.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(response.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", response.StatusCode, string(body))
+		return AIResponse{}, &APIError{StatusCode: response.StatusCode, Body: string(body), RequestID: requestID, ProviderID: providerID}
+	}
+
+	if stall := apiClient.config.StreamStallTimeout; stall > 0 {
+		watchdog := time.AfterFunc(stall, func() { cancelCause(errStreamStalled) })
+		defer watchdog.Stop()
+		display := onDelta
+		onDelta = func(channel StreamChannel, text string) {
+			watchdog.Reset(stall)
+			if display != nil {
+				display(channel, text)
+			}
+		}
+	}
+
+	finish := func(aiResponse *AIResponse) {
+		if apiClient.config.TrimStopFragments {
+			aiResponse.Content = trimStopFragments(aiResponse.Content, stopSequences)
+		}
+		aiResponse.RequestID = requestID
+		if providerID != "" {
+			aiResponse.ProviderID = providerID
+		}
+	}
+
+	aiResponse, err := processStreamResponse(response.Body, onDelta, apiClient.config.LoopRepeatThreshold)
+	var partial *PartialResponseError
+	if errors.As(err, &partial) {
+		finish(&partial.Partial)
+	}
+	if err != nil && errors.Is(context.Cause(ctx), errStreamStalled) {
+		stalled := fmt.Errorf("%w: no content for %v", errStreamStalled, apiClient.config.StreamStallTimeout)
+		if partial != nil {
+			partial.Err = stalled
+		} else {
+			err = stalled
+		}
+	}
+	if err != nil {
+		return AIResponse{}, fmt.Errorf("%s: %w", describeRequestIDs(requestID, providerID), err)
+	}
+	finish(&aiResponse)
+	return aiResponse, nil
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
 	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func describeRequestIDs(requestID, providerID string) string {
+	if providerID == "" {
+		return "request " + requestID
+	}
+	return fmt.Sprintf("request %s, provider request %s", requestID, providerID)
+}
 
-	return processStreamResponse(response.Body)
+func trimStopFragments(content string, stops []string) string {
+	content = strings.TrimRightFunc(content, unicode.IsSpace)
+	for _, stop := range stops {
+		lead := len(stop) - len(strings.TrimLeftFunc(stop, unicode.IsSpace))
+		for k := len(stop); k >= lead+minStopFragment; k-- {
+			if strings.HasSuffix(content, stop[:k]) {
+				return strings.TrimRightFunc(strings.TrimSuffix(content, stop[:k]), unicode.IsSpace)
+			}
+		}
+	}
+	return content
 }
 
-func (c *APIClient) sendRequest(ctx context.Context, conversation *Conversation) (*http.Response, error) {
-	truncatedHistory := truncateConversation(conversation.getHistory(), maxTokens)
-	requestBody, err := createRequestBody(truncatedHistory)
+func (c *APIClient) sendRequest(ctx context.Context, conversation *Conversation, model, requestID string) (*http.Response, error) {
+	maxTokens := c.outputTokenLimit(model)
+	if c.maxTokens > maxTokens {
+		log.Printf("Clamping max_tokens from %d to %d, the output limit of %s", c.maxTokens, maxTokens, model)
+	}
+	requestBody, err := c.createRequestBody(c.requestHistory(conversation, model), model, maxTokens)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request body: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(requestBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(requestBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("User-Agent", "AIChat/1.0")
+	if c.config.RequestIDHeader != "" {
+		req.Header.Set(c.config.RequestIDHeader, requestID)
+	}
+	c.setCommonHeaders(req)
 
 	return c.httpClient.Do(req)
 }
 
+func (c *APIClient) setCommonHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	for name, value := range c.config.ExtraHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+}
+
+func (c *APIClient) requestHistory(conversation *Conversation, model string) []Message {
+	profile := c.config.modelProfile(model)
+	ephemeral := make([]Message, len(c.ephemeral))
+	for i, note := range c.ephemeral {
+		ephemeral[i] = Message{Role: "system", Content: note}
+	}
+	budget := min(profile.ContextWindow-c.outputTokenLimit(model), conversation.getWindow()) - countTokens(c.examples) - countTokens(ephemeral)
+	history := withEphemeralContext(truncateConversation(conversation.getHistory(), budget), c.ephemeral)
+	if len(c.examples) == 0 {
+		return history
+	}
+
+	split := 0
+	if len(history) > 0 && history[0].Role == "system" {
+		split = 1
+	}
+	withExamples := append([]Message(nil), history[:split]...)
+	withExamples = append(withExamples, c.examples...)
+	return append(withExamples, history[split:]...)
+}
+
 func truncateConversation(history []Message, maxTokens int) []Message {
-	var truncated []Message
+	keep := make([]bool, len(history))
 	totalTokens := 0
+	for i, message := range history {
+		if message.Pinned || (i == 0 && message.Role == "system") {
+			keep[i] = true
+			totalTokens += len(strings.Fields(message.Content))
+		}
+	}
 
 	for i := len(history) - 1; i >= 0; i-- {
-		message := history[i]
-		tokens := len(strings.Fields(message.Content))
+		if keep[i] {
+			continue
+		}
+		tokens := len(strings.Fields(history[i].Content))
 		if totalTokens+tokens > maxTokens {
 			break
 		}
 		totalTokens += tokens
-		truncated = append([]Message{message}, truncated...)
+		keep[i] = true
 	}
 
+	var truncated []Message
+	for i, message := range history {
+		if keep[i] {
+			truncated = append(truncated, message)
+		}
+	}
 	return truncated
 }
 
-func createRequestBody(truncatedHistory []Message) ([]byte, error) {
-	currentTime := time.Now()
-	systemMessage := fmt.Sprintf("Current date and time: %s", currentTime.Format(time.RFC3339))
-
-	apiMessages := []APIMessage{
-		{Role: "system", Content: systemMessage},
+func (c *APIClient) createRequestBody(truncatedHistory []Message, model string, maxTokens int) ([]byte, error) {
+	var apiMessages []APIMessage
+	if c.config.InjectDateTime {
+		currentTime := time.Now().In(c.config.location)
+		systemMessage := fmt.Sprintf("Current date and time: %s", currentTime.Format(c.config.DateTimeFormat))
+		apiMessages = append(apiMessages, APIMessage{Role: "system", Content: systemMessage})
 	}
 
+	vision := c.config.modelProfile(model).Vision
 	for _, msg := range truncatedHistory {
 		apiMessages = append(apiMessages, APIMessage{
 			Role:    msg.Role,
-			Content: msg.Content,
+			Content: messageContent(msg, vision),
 		})
 	}
 
+	if c.prefill != "" {
+		apiMessages = append(apiMessages, APIMessage{Role: "assistant", Content: c.prefill})
+	}
+
+	preset, _ := c.config.samplingPreset(c.preset)
 	body := map[string]interface{}{
 		"messages":    apiMessages,
-		"model":       "llama-3.1-70b-versatile",
-		"temperature": 0.7,
+		"model":       model,
+		"temperature": preset.Temperature,
 		"max_tokens":  maxTokens,
-		"top_p":       0.9,
+		"top_p":       preset.TopP,
 		"stream":      true,
-		"stop":        []string{"\n\nHuman:", "\n\nAssistant:"},
+		"stop":        stopSequences,
+	}
+
+	if penalty := min(c.config.FrequencyPenalty+c.penaltyBoost, 2); penalty != 0 {
+		body["frequency_penalty"] = penalty
+	}
+
+	if c.config.PresencePenalty != 0 {
+		body["presence_penalty"] = c.config.PresencePenalty
+	}
+
+	if c.config.Seed != nil {
+		body["seed"] = *c.config.Seed
+	}
+
+	if len(c.config.LogitBias) > 0 {
+		body["logit_bias"] = c.config.LogitBias
+	}
+
+	if c.jsonMode {
+		body["response_format"] = map[string]string{"type": "json_object"}
 	}
 
 	return json.Marshal(body)
 }
 
-func processStreamResponse(body io.Reader) (string, error) {
+func processStreamResponse(body io.Reader, onDelta func(StreamChannel, string), loopThreshold int) (AIResponse, error) {
 	scanner := bufio.NewScanner(body)
-	var buffer strings.Builder
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	var buffer, reasoning strings.Builder
+	var eventData []string
+	var usage *Usage
 	var lastError error
+	var completionID string
+	looping := false
+	var splitter thinkSplitter
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
+	emit := func(channel StreamChannel, text string) {
+		if text == "" {
+			return
+		}
+		if channel == ReasoningChannel {
+			reasoning.WriteString(text)
+		} else {
+			buffer.WriteString(text)
+		}
+		if onDelta != nil {
+			onDelta(channel, text)
+		}
+	}
+
+	dispatchEvent := func() bool {
+		if len(eventData) == 0 {
+			return false
 		}
+		data := strings.Join(eventData, "\n")
+		eventData = eventData[:0]
 
-		data := strings.TrimPrefix(line, "data: ")
 		if data == "[DONE]" {
-			break
+			return true
 		}
 
 		var jsonResponse map[string]interface{}
 		if err := json.Unmarshal([]byte(data), &jsonResponse); err != nil {
 			lastError = err
-			continue
+			return false
 		}
 
 		if content := extractContent(jsonResponse); content != "" {
-			buffer.WriteString(content)
+			answer, thought := splitter.split(content)
+			emit(ReasoningChannel, thought)
+			emit(AnswerChannel, answer)
+			if detectLoop(buffer.String(), loopThreshold) {
+				looping = true
+				return true
+			}
+		}
+
+		emit(ReasoningChannel, extractReasoning(jsonResponse))
+
+		if chunkUsage := extractUsage(jsonResponse); chunkUsage != nil {
+			usage = chunkUsage
+		}
+		if id, ok := jsonResponse["id"].(string); ok && completionID == "" {
+			completionID = id
+		}
+		return false
+	}
+
+	done := false
+	for !done && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			done = dispatchEvent()
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "data:"):
+			eventData = append(eventData, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("failed to read stream: %w", err)
+		err = fmt.Errorf("failed to read stream: %w", err)
+		if buffer.Len() > 0 {
+			return AIResponse{}, &PartialResponseError{
+				Partial: AIResponse{Content: buffer.String(), Reasoning: strings.TrimSpace(reasoning.String())},
+				Err:     err,
+			}
+		}
+		return AIResponse{}, err
+	}
+
+	if !done {
+		dispatchEvent()
 	}
+	emit(splitter.flush())
+
+	if looping {
+		return AIResponse{}, errLoopDetected
+	}
+
+	if lastError != nil && buffer.Len() == 0 && reasoning.Len() == 0 {
+		return AIResponse{}, fmt.Errorf("error processing stream: %w", lastError)
+	}
+
+	return AIResponse{
+		Content:    buffer.String(),
+		Reasoning:  strings.TrimSpace(reasoning.String()),
+		Usage:      usage,
+		ProviderID: completionID,
+	}, nil
+}
+
+type StreamChannel int
 
-	if lastError != nil {
-		return "", fmt.Errorf("error processing stream: %w", lastError)
+const (
+	AnswerChannel StreamChannel = iota
+	ReasoningChannel
+)
+
+type thinkSplitter struct {
+	inThink bool
+	pending string
+}
+
+func (s *thinkSplitter) split(text string) (answer, reasoning string) {
+	text = s.pending + text
+	s.pending = ""
+
+	var answerPart, reasoningPart strings.Builder
+	for text != "" {
+		current, tag := &answerPart, "<think>"
+		if s.inThink {
+			current, tag = &reasoningPart, "</think>"
+		}
+
+		if i := strings.Index(text, tag); i >= 0 {
+			current.WriteString(text[:i])
+			text = text[i+len(tag):]
+			s.inThink = !s.inThink
+			continue
+		}
+
+		keep := 0
+		for k := len(tag) - 1; k > 0; k-- {
+			if strings.HasSuffix(text, tag[:k]) {
+				keep = k
+				break
+			}
+		}
+		current.WriteString(text[:len(text)-keep])
+		s.pending = text[len(text)-keep:]
+		break
 	}
+	return answerPart.String(), reasoningPart.String()
+}
 
-	return strings.TrimSpace(buffer.String()), nil
+func (s *thinkSplitter) flush() (StreamChannel, string) {
+	pending := s.pending
+	s.pending = ""
+	if s.inThink {
+		return ReasoningChannel, pending
+	}
+	return AnswerChannel, pending
 }
 
 func extractContent(jsonResponse map[string]interface{}) string {
+	choice := extractChoice(jsonResponse)
+	if choice == nil {
+		return ""
+	}
+
+	for _, key := range []string{"delta", "message"} {
+		if part, ok := choice[key].(map[string]interface{}); ok {
+			if content, ok := part["content"].(string); ok && content != "" {
+				return content
+			}
+		}
+	}
+
+	content, _ := choice["text"].(string)
+	return content
+}
+
+func extractReasoning(jsonResponse map[string]interface{}) string {
+	delta := extractDelta(jsonResponse)
+	if delta == nil {
+		return ""
+	}
+
+	for _, key := range []string{"reasoning", "reasoning_content"} {
+		if content, ok := delta[key].(string); ok && content != "" {
+			return content
+		}
+	}
+
+	return ""
+}
+
+func extractChoice(jsonResponse map[string]interface{}) map[string]interface{} {
 	choices, ok := jsonResponse["choices"].([]interface{})
 	if !ok || len(choices) == 0 {
-		return ""
+		return nil
 	}
 
 	choice, ok := choices[0].(map[string]interface{})
 	if !ok {
-		return ""
+		return nil
 	}
 
-	delta, ok := choice["delta"].(map[string]interface{})
+	return choice
+}
+
+func extractUsage(jsonResponse map[string]interface{}) *Usage {
+	raw, ok := jsonResponse["usage"].(map[string]interface{})
 	if !ok {
-		return ""
+		if groq, ok := jsonResponse["x_groq"].(map[string]interface{}); ok {
+			raw, ok = groq["usage"].(map[string]interface{})
+		}
+		if !ok {
+			return nil
+		}
+	}
+
+	tokens := func(key string) int {
+		value, _ := raw[key].(float64)
+		return int(value)
+	}
+
+	return &Usage{
+		PromptTokens:     tokens("prompt_tokens"),
+		CompletionTokens: tokens("completion_tokens"),
+		TotalTokens:      tokens("total_tokens"),
+	}
+}
+
+func extractDelta(jsonResponse map[string]interface{}) map[string]interface{} {
+	choice := extractChoice(jsonResponse)
+	if choice == nil {
+		return nil
 	}
 
-	content, ok := delta["content"].(string)
+	delta, ok := choice["delta"].(map[string]interface{})
 	if !ok {
-		return ""
+		return nil
 	}
 
-	return content
+	return delta
+}
+
+func clearScreen(out io.Writer) {
+	fmt.Fprint(out, "\033[2J\033[H")
 }
 
-func clearScreen() {
-	fmt.Print("\033[2J\033[H")
+func (s *ChatSession) printResponse(ctx context.Context, content string) {
+	column := s.printLabel("assistant")
+	prefix, suffix := s.apiClient.config.ResponsePrefix, s.apiClient.config.ResponseSuffix
+	if prefix != "" {
+		fmt.Fprint(s.out, prefix)
+		if i := strings.LastIndex(prefix, "\n"); i >= 0 {
+			column = visibleLength(prefix[i+1:])
+		} else {
+			column += visibleLength(prefix)
+		}
+	}
+	s.printStreamingResponse(ctx, content, column)
+	if suffix != "" {
+		fmt.Fprintln(s.out, suffix)
+	}
 }
 
-func printStreamingResponse(response string) {
+func (s *ChatSession) printStreamingResponse(ctx context.Context, response string, column int) {
+	out := newCoalescingWriter(s.out, s.apiClient.config.StreamFlushInterval)
+	defer out.Flush()
+
+	width := s.wrapColumn()
+	delay := time.Duration(s.apiClient.config.StreamDelayMillis) * time.Millisecond
+	skippable := s.terminal.Interactive && delay > 0
 	words := strings.Fields(response)
 	for i, word := range words {
-		fmt.Print(word)
-		if i < len(words)-1 {
-			fmt.Print(" ")
+		if ctx.Err() != nil {
+			break
+		}
+
+		wordLength := utf8.RuneCountInString(word)
+		if i > 0 {
+			if width > 0 && column+1+wordLength > width {
+				fmt.Fprintln(out)
+				column = 0
+			} else {
+				fmt.Fprint(out, " ")
+				column++
+			}
+		}
+
+		fmt.Fprint(out, word)
+		column += wordLength
+		if delay > 0 && skippable && s.input.skipRequested() {
+			delay = 0
+		}
+		if delay > 0 {
+			time.Sleep(delay)
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
-	fmt.Println()
+	fmt.Fprintln(out)
+}
+
+func printReasoning(out io.Writer, reasoning string) {
+	fmt.Fprintf(out, "%sThinking:%s\n", colorDim, colorReset)
+	fmt.Fprintf(out, "%s%s%s\n", colorDim, reasoning, colorReset)
+	fmt.Fprintf(out, "%s%s%s\n", colorDim, strings.Repeat("─", 20), colorReset)
+}
+
+type savedConversation struct {
+	Title    string    `json:"title,omitempty"`
+	Messages []Message `json:"messages"`
 }
 
-func saveConversation(conversation *Conversation) error {
-	filename := fmt.Sprintf("conversation_%s.json", time.Now().Format("20060102_150405"))
-	data, err := json.MarshalIndent(conversation.getHistory(), "", "  ")
+func saveConversationAs(out io.Writer, conversation *Conversation, filename string) error {
+	data, err := json.MarshalIndent(savedConversation{Title: conversation.getTitle(), Messages: conversation.getHistory()}, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal conversation: %w", err)
 	}
 
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+
 	if err := os.WriteFile(filename, data, 0644); err != nil {
 		return fmt.Errorf("failed to write conversation file: %w", err)
 	}
 
-	fmt.Printf("%sConversation saved to %s%s\n", colorGreen, filename, colorReset)
+	fmt.Fprintf(out, "%sConversation saved to %s%s\n", colorGreen, filename, colorReset)
 	return nil
 }
 
+func resolveSessionPath(filename, sessionsDir string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return filename
+	}
+	return filepath.Join(sessionsDir, filename)
+}
+
 func loadConversation(filename string) (*Conversation, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read conversation file: %w", err)
 	}
 
-	var history []Message
-	if err := json.Unmarshal(data, &history); err != nil {
+	var saved savedConversation
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &saved.Messages)
+	} else {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal conversation: %w", err)
 	}
+	history := saved.Messages
 
-	conversation := &Conversation{History: history}
+	savedAt := time.Now()
+	if info, err := os.Stat(filename); err == nil {
+		savedAt = info.ModTime()
+	}
+	assignTimestamps(history, savedAt)
+
+	conversation := &Conversation{Title: saved.Title, History: history}
 	conversation.tokenCount = countTokens(history)
 	return conversation, nil
 }
 
+// assignTimestamps gives loaded messages synthetic, strictly increasing
+// timestamps one second apart, ending at savedAt, since saved files do not
+// record when each message was sent.
+func assignTimestamps(history []Message, savedAt time.Time) {
+	for i := range history {
+		history[i].Timestamp = savedAt.Add(-time.Duration(len(history)-1-i) * time.Second)
+	}
+}
+
 func countTokens(messages []Message) int {
 	count := 0
 	for _, msg := range messages {
@@ -524,22 +3003,49 @@ func countTokens(messages []Message) int {
 	return count
 }
 
-func printConversationSummary(conversation *Conversation) {
-	fmt.Printf("%sConversation Summary:%s\n", colorCyan, colorReset)
-	fmt.Printf("Total messages: %d\n", len(conversation.History))
-	fmt.Printf("Total tokens: %d\n", conversation.tokenCount)
-	fmt.Println("Last 3 exchanges:")
-	for i := max(0, len(conversation.History)-6); i < len(conversation.History); i++ {
+func printConversationSummary(out io.Writer, conversation *Conversation, config *Config) {
+	fmt.Fprintf(out, "%sConversation Summary:%s\n", colorCyan, colorReset)
+	if conversation.Title != "" {
+		fmt.Fprintf(out, "Title: %s\n", conversation.Title)
+	}
+	fmt.Fprintf(out, "Total messages: %d\n", len(conversation.History))
+	fmt.Fprintf(out, "Total tokens: %d\n", conversation.tokenCount)
+	if config.SummaryExchanges == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Last %d exchanges:\n", config.SummaryExchanges)
+	for i := max(0, len(conversation.History)-2*config.SummaryExchanges); i < len(conversation.History); i++ {
 		msg := conversation.History[i]
-		fmt.Printf("%s%s:%s %s\n", colorYellow, msg.Role, colorReset, truncateString(msg.Content, 50))
+		fmt.Fprintf(out, "%s%s:%s %s\n", colorYellow, config.roleLabel(msg.Role), colorReset, truncateString(msg.Content, config.SummaryMaxChars))
 	}
 }
 
 func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
+	if visibleLength(s) <= maxLen {
 		return s
 	}
-	return s[:maxLen-3] + "..."
+	if maxLen < 4 {
+		return strings.Repeat(".", max(maxLen, 0))
+	}
+
+	var b strings.Builder
+	visible, escaped := 0, false
+	for i := 0; i < len(s) && visible < maxLen-3; {
+		if n := escapeSequenceLength(s[i:]); n > 0 {
+			b.WriteString(s[i : i+n])
+			i += n
+			escaped = true
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+size])
+		i += size
+		visible++
+	}
+	if escaped {
+		b.WriteString("\033[0m")
+	}
+	return b.String() + "..."
 }
 
 func max(a, b int) int {
@@ -549,19 +3055,140 @@ func max(a, b int) int {
 	return b
 }
 
+func (c *Conversation) lastUserMessage() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := len(c.History) - 1; i >= 0; i-- {
+		if c.History[i].Role == "user" {
+			return c.History[i].Content
+		}
+	}
+	return ""
+}
+
+func (c *Conversation) lastAssistantMessages(n int) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var messages []string
+	for i := len(c.History) - 1; i >= 0 && len(messages) < n; i-- {
+		if c.History[i].Role == "assistant" {
+			messages = append(messages, c.History[i].Content)
+		}
+	}
+	slices.Reverse(messages)
+	return messages
+}
+
+func (c *Conversation) attachImages(images []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.History) > 0 {
+		last := &c.History[len(c.History)-1]
+		last.Images = append(last.Images, images...)
+		c.dirty = true
+	}
+}
+
+func (c *Conversation) mergeAdjacentRoles() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	merged := 0
+	var kept []Message
+	for _, msg := range c.History {
+		if n := len(kept); n > 0 && kept[n-1].Role == msg.Role {
+			last := &kept[n-1]
+			last.Content += "\n\n" + msg.Content
+			last.Pinned = last.Pinned || msg.Pinned
+			last.Images = append(last.Images, msg.Images...)
+			merged++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	c.History = kept
+	if merged > 0 {
+		c.dirty = true
+	}
+	return merged
+}
+
+func (c *Conversation) getTitle() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Title
+}
+
+func (c *Conversation) setTitle(title string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Title = title
+	c.dirty = true
+}
+
+func (c *Conversation) setPinned(index int, pinned bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index >= len(c.History) {
+		return fmt.Errorf("no message at index %d", index+1)
+	}
+	c.History[index].Pinned = pinned
+	c.dirty = true
+	return nil
+}
+
+func (c *Conversation) isDirty() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dirty
+}
+
+func (c *Conversation) markSaved() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty = false
+}
+
+func (c *Conversation) removeTrailingUserMessage() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.History); n > 0 && c.History[n-1].Role == "user" {
+		c.tokenCount -= len(strings.Fields(c.History[n-1].Content))
+		c.History = c.History[:n-1]
+		c.dirty = true
+	}
+}
+
+func (c *Conversation) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var kept []Message
+	if len(c.History) > 0 && c.History[0].Role == "system" {
+		kept = append(kept, c.History[0])
+	}
+	c.History = kept
+	c.tokenCount = countTokens(kept)
+	c.dirty = true
+}
+
+func (c *Conversation) snapshot() *Conversation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &Conversation{
+		Title:              c.Title,
+		History:            append([]Message(nil), c.History...),
+		tokenCount:         c.tokenCount,
+		maxTokens:          c.maxTokens,
+		keepFullHistory:    c.keepFullHistory,
+		maxHistoryMessages: c.maxHistoryMessages,
+	}
+}
+
 func (c *Conversation) replaceWith(other *Conversation) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.Title = other.Title
 	c.History = other.History
 	c.tokenCount = other.tokenCount
+	c.dirty = true
 }
-
-const (
-	colorReset  = "\033[0m"
-	colorRed    = "\033[31m"
-	colorGreen  = "\033[32m"
-	colorYellow = "\033[33m"
-	colorBlue   = "\033[34m"
-	colorPurple = "\033[35m"
-	colorCyan   = "\033[36m"
-)
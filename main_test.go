@@ -0,0 +1,859 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTrimStopFragments(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain answer", "Hello there.", "Hello there."},
+		{"full stop sequence", "Hello.\n\nHuman:", "Hello."},
+		{"role without colon", "Hello.\n\nAssistant", "Hello."},
+		{"partial role", "Hello.\n\nHuma", "Hello."},
+		{"trailing whitespace", "Hello.\n\nHuman: \n", "Hello."},
+		{"one letter option", "Which option is correct?\n\nA", "Which option is correct?\n\nA"},
+		{"single newline", "Answer: yes\nAs", "Answer: yes\nAs"},
+		{"short prefix", "See below.\n\nHum", "See below.\n\nHum"},
+		{"role mid text", "Human: hi", "Human: hi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimStopFragments(tt.content, stopSequences); got != tt.want {
+				t.Errorf("trimStopFragments(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithPrefillKeepsJoiningWhitespace(t *testing.T) {
+	response, err := processStreamResponse(strings.NewReader(sseEvents(" the", " answer\n")), nil, 0)
+	if err != nil {
+		t.Fatalf("processStreamResponse: %v", err)
+	}
+
+	client := &APIClient{prefill: "Sure, here is"}
+	if got, want := client.withPrefill(response.Content), "Sure, here is the answer"; got != want {
+		t.Errorf("withPrefill = %q, want %q", got, want)
+	}
+
+	client.prefill = ""
+	if got, want := client.withPrefill(response.Content), "the answer"; got != want {
+		t.Errorf("withPrefill without prefill = %q, want %q", got, want)
+	}
+}
+
+func sseEvents(contents ...string) string {
+	var b strings.Builder
+	for _, content := range contents {
+		data, _ := json.Marshal(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"delta": map[string]string{"content": content}}},
+		})
+		fmt.Fprintf(&b, "data: %s\n\n", data)
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.String()
+}
+
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(r.size, len(p), len(r.data))
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestProcessStreamResponseSplitRunes(t *testing.T) {
+	want := "漢字 and 😀 survive"
+	body := sseEvents("漢字", " and 😀", " survive")
+	for size := 1; size <= 4; size++ {
+		var deltas []string
+		response, err := processStreamResponse(&chunkReader{data: []byte(body), size: size}, func(_ StreamChannel, text string) {
+			deltas = append(deltas, text)
+		}, 0)
+		if err != nil {
+			t.Fatalf("size %d: processStreamResponse: %v", size, err)
+		}
+		if response.Content != want {
+			t.Errorf("size %d: content = %q, want %q", size, response.Content, want)
+		}
+		for _, delta := range deltas {
+			if !utf8.ValidString(delta) {
+				t.Errorf("size %d: delta %q is not valid UTF-8", size, delta)
+			}
+		}
+	}
+}
+
+func TestProcessStreamResponseCommentsAndMalformedChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "comments between events",
+			body: ": keep-alive\n\n" + strings.TrimSuffix(sseEvents("Hello"), "data: [DONE]\n\n") +
+				": still here\n\n" + sseEvents(" world"),
+			want: "Hello world",
+		},
+		{
+			name: "malformed chunk after content",
+			body: strings.TrimSuffix(sseEvents("Hello"), "data: [DONE]\n\n") + "data: {not json\n\n" + sseEvents(" again"),
+			want: "Hello again",
+		},
+		{
+			name:    "malformed chunks only",
+			body:    "data: {not json\n\n: comment\n\ndata: [1,\n\ndata: [DONE]\n\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := processStreamResponse(strings.NewReader(tt.body), nil, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got content %q", response.Content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("processStreamResponse: %v", err)
+			}
+			if response.Content != tt.want {
+				t.Errorf("content = %q, want %q", response.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessStreamResponseChunkBoundaries(t *testing.T) {
+	body := ": opening comment\n\n" +
+		"data: {\"choices\":[{\"delta\":\n" +
+		"data: {\"content\":\"multi-line \"}}]}\n\n" +
+		sseEvents("event", " assembled")
+	for size := 1; size <= 7; size++ {
+		response, err := processStreamResponse(&chunkReader{data: []byte(body), size: size}, nil, 0)
+		if err != nil {
+			t.Fatalf("size %d: processStreamResponse: %v", size, err)
+		}
+		if want := "multi-line event assembled"; response.Content != want {
+			t.Errorf("size %d: content = %q, want %q", size, response.Content, want)
+		}
+	}
+}
+
+func TestExtractContent(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"delta content", `{"choices":[{"delta":{"content":"streamed"}}]}`, "streamed"},
+		{"message content", `{"choices":[{"message":{"role":"assistant","content":"whole"}}]}`, "whole"},
+		{"text completion", `{"choices":[{"text":"legacy"}]}`, "legacy"},
+		{"empty delta falls back to text", `{"choices":[{"delta":{},"text":"fallback"}]}`, "fallback"},
+		{"no choices", `{"choices":[]}`, ""},
+		{"missing choices", `{"id":"chatcmpl-1"}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.json), &payload); err != nil {
+				t.Fatalf("bad test JSON: %v", err)
+			}
+			if got := extractContent(payload); got != tt.want {
+				t.Errorf("extractContent(%s) = %q, want %q", tt.json, got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestClient(t *testing.T, baseURL string, extraConfig string) *APIClient {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf("groq_api_key: gsk_%s\nbase_url: %s\nsessions_dir: %s\n%s", strings.Repeat("x", 32), baseURL, t.TempDir(), extraConfig)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	client := newAPIClient(config)
+	t.Cleanup(client.close)
+	return client
+}
+
+func testConversation() *Conversation {
+	conversation := &Conversation{}
+	conversation.addMessage("user", "hi")
+	return conversation
+}
+
+func TestTransientNetworkErrorRetriesOnceWithoutBackoff(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseEvents("recovered"))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "")
+	start := time.Now()
+	response, err := getAIResponseFromModel(context.Background(), client, testConversation(), client.model, 1, nil)
+	if err != nil {
+		t.Fatalf("getAIResponseFromModel: %v", err)
+	}
+	if response.Content != "recovered" {
+		t.Errorf("content = %q, want %q", response.Content, "recovered")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("server saw %d requests, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed >= initialBackoff/2 {
+		t.Errorf("retry took %v, expected no backoff", elapsed)
+	}
+}
+
+func TestMidStreamFailureReturnsPartialResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, strings.TrimSuffix(sseEvents("partial answer"), "data: [DONE]\n\n"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "stream_stall_timeout: 0s\n")
+	_, err := getAIResponseWithRetry(context.Background(), client, testConversation(), nil)
+	var partial *PartialResponseError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a PartialResponseError, got %v", err)
+	}
+	if partial.Partial.Content != "partial answer" {
+		t.Errorf("partial content = %q, want %q", partial.Partial.Content, "partial answer")
+	}
+	if partial.Partial.Model != client.model || partial.Partial.RequestID == "" {
+		t.Errorf("partial response was not finalised: model %q, request ID %q", partial.Partial.Model, partial.Partial.RequestID)
+	}
+	if totals := client.usage.snapshot()[client.model]; totals.CompletionTokens == 0 {
+		t.Error("usage of the partial response was not recorded")
+	}
+}
+
+func TestKeepPartialDoesNotPromptWithoutTerminal(t *testing.T) {
+	for _, keep := range []bool{true, false} {
+		client := newTestClient(t, apiBaseURL, fmt.Sprintf("continue_on_error: true\nkeep_partial_replies: %v\n", keep))
+		session := &ChatSession{apiClient: client, input: newLineReader(strings.NewReader("next message\n")), out: io.Discard}
+		partial := &PartialResponseError{Partial: AIResponse{Content: "cut"}, Err: io.ErrUnexpectedEOF}
+
+		if got := session.keepPartial(context.Background(), partial); got != keep {
+			t.Errorf("keep_partial_replies %v: keepPartial = %v", keep, got)
+		}
+		if line, err := session.input.readLine(context.Background(), 0); err != nil || line != "next message" {
+			t.Errorf("keep_partial_replies %v: next input = %q, %v; the prompt consumed it", keep, line, err)
+		}
+	}
+}
+
+func TestEnforceInputLimitRejectsWithoutTerminal(t *testing.T) {
+	client := newTestClient(t, apiBaseURL, "max_user_input_chars: 5\n")
+	session := &ChatSession{apiClient: client, input: newLineReader(strings.NewReader("y\n")), out: io.Discard}
+
+	if got, ok := enforceInputLimit(context.Background(), session, "short"); !ok || got != "short" {
+		t.Errorf("within the limit: got %q, %v", got, ok)
+	}
+	if got, ok := enforceInputLimit(context.Background(), session, "too long"); ok || got != "" {
+		t.Errorf("over the limit: got %q, %v; want the message rejected", got, ok)
+	}
+	if line, err := session.input.readLine(context.Background(), 0); err != nil || line != "y" {
+		t.Errorf("next input = %q, %v; the prompt consumed it", line, err)
+	}
+}
+
+func TestStreamStallTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		partial string
+	}{
+		{"before any content", ""},
+		{"after partial content", "partial"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				if tc.partial != "" {
+					io.WriteString(w, strings.TrimSuffix(sseEvents(tc.partial), "data: [DONE]\n\n"))
+				}
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+			}))
+			defer server.Close()
+			defer close(release)
+
+			client := newTestClient(t, server.URL, "stream_stall_timeout: 100ms\n")
+			start := time.Now()
+			_, err := getAIResponse(context.Background(), client, testConversation(), client.model, nil)
+			if !errors.Is(err, errStreamStalled) {
+				t.Fatalf("expected errStreamStalled, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("stall was detected after %v", elapsed)
+			}
+
+			var partial *PartialResponseError
+			if got := errors.As(err, &partial); got != (tc.partial != "") {
+				t.Fatalf("PartialResponseError = %v, want %v (err: %v)", got, tc.partial != "", err)
+			}
+			if partial != nil && partial.Partial.Content != tc.partial {
+				t.Errorf("partial content = %q, want %q", partial.Partial.Content, tc.partial)
+			}
+		})
+	}
+}
+
+func TestMaxTokensClampedToModelOutputLimit(t *testing.T) {
+	var sent atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			MaxTokens int64 `json:"max_tokens"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		sent.Store(body.MaxTokens)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseEvents("ok"))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "")
+	limit := client.config.modelProfile(client.model).MaxOutputTokens
+	if err := client.validateMaxTokens(limit + 1); err == nil {
+		t.Errorf("validateMaxTokens(%d) accepted a value above the output limit", limit+1)
+	}
+	if err := client.validateMaxTokens(limit); err != nil {
+		t.Errorf("validateMaxTokens(%d): %v", limit, err)
+	}
+
+	client.maxTokens = limit * 2
+	if _, err := getAIResponse(context.Background(), client, testConversation(), client.model, nil); err != nil {
+		t.Fatalf("getAIResponse: %v", err)
+	}
+	if got := sent.Load(); got != int64(limit) {
+		t.Errorf("max_tokens sent = %d, want the output limit %d", got, limit)
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		maxLen int
+		want   string
+	}{
+		{"fits", "hello", 5, "hello"},
+		{"ascii", "hello world", 8, "hello..."},
+		{"multibyte", "héllo wörld", 8, "héllo..."},
+		{"wide runes", "日本語のテキスト", 6, "日本語..."},
+		{"ansi", "\033[1mbold text\033[0m", 7, "\033[1mbold\033[0m..."},
+		{"ansi fits", "\033[1mbold\033[0m", 4, "\033[1mbold\033[0m"},
+		{"tiny limit", "hello", 2, ".."},
+		{"zero limit", "hello", 0, ""},
+		{"negative limit", "hello", -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateString(tt.input, tt.maxLen)
+			if got != tt.want {
+				t.Errorf("truncateString(%q, %d) = %q, want %q", tt.input, tt.maxLen, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateString(%q, %d) produced invalid UTF-8", tt.input, tt.maxLen)
+			}
+			if n := visibleLength(got); n > max(tt.maxLen, 0) {
+				t.Errorf("truncateString(%q, %d) is %d characters wide", tt.input, tt.maxLen, n)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	const backoff = 4 * time.Second
+	lowest := func(int64) int64 { return 0 }
+	highest := func(n int64) int64 { return n - 1 }
+
+	tests := []struct {
+		strategy string
+		min, max time.Duration
+	}{
+		{"full", 0, backoff - 1},
+		{"equal", backoff / 2, backoff - 1},
+		{"none", backoff, backoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			if got := retryDelay(tt.strategy, backoff, lowest); got != tt.min {
+				t.Errorf("lowest draw: got %v, want %v", got, tt.min)
+			}
+			if got := retryDelay(tt.strategy, backoff, highest); got != tt.max {
+				t.Errorf("highest draw: got %v, want %v", got, tt.max)
+			}
+
+			seeded, reference := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				got := retryDelay(tt.strategy, backoff, seeded.Int63n)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("draw %d: %v outside [%v, %v]", i, got, tt.min, tt.max)
+				}
+				if want := retryDelay(tt.strategy, backoff, reference.Int63n); got != want {
+					t.Fatalf("draw %d: %v differs from %v with the same seed", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		prefix  string
+		wantErr bool
+	}{
+		{"groq key", "gsk_" + strings.Repeat("x", 32), "gsk_", false},
+		{"truncated groq key", "gsk_short", "gsk_", true},
+		{"wrong prefix", strings.Repeat("x", 32), "gsk_", true},
+		{"short key without prefix check", "local", "", false},
+		{"whitespace", "gsk_" + strings.Repeat("x", 32) + "\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAPIKey(tt.key, tt.prefix); (err != nil) != tt.wantErr {
+				t.Errorf("validateAPIKey(%q, %q) = %v, wantErr %v", tt.key, tt.prefix, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestURLAndPromptBothReachTheNextMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "page text")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseEvents("ok"))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "prompts:\n  review: Review this.\n")
+	session := &ChatSession{apiClient: client, conversation: &Conversation{}, out: io.Discard}
+	ctx := context.Background()
+
+	if err := handleURLCommand(ctx, "/url "+server.URL+"/page", session); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlePromptCommand("/prompt review", session); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendUserInput(ctx, session, "question"); err != nil {
+		t.Fatal(err)
+	}
+
+	history := session.conversation.getHistory()
+	if len(history) == 0 {
+		t.Fatal("no message was sent")
+	}
+	sent := history[0].Content
+	for _, part := range []string{"Review this.", "page text", "question"} {
+		if !strings.Contains(sent, part) {
+			t.Errorf("sent message %q is missing %q", sent, part)
+		}
+	}
+	if session.pendingPrompt != "" || len(session.pendingPages) > 0 {
+		t.Error("pending prompt or pages were not cleared after sending")
+	}
+}
+
+func TestContinueOnErrorDefaultsUnsetUntilExplicit(t *testing.T) {
+	client := newTestClient(t, apiBaseURL, "")
+	if client.config.ContinueOnError != nil {
+		t.Errorf("continue_on_error should stay unset so run can pick a default, got %v", *client.config.ContinueOnError)
+	}
+	if !client.config.continueOnError() {
+		t.Error("an unset continue_on_error should continue")
+	}
+
+	client = newTestClient(t, apiBaseURL, "continue_on_error: false\n")
+	if client.config.ContinueOnError == nil || client.config.continueOnError() {
+		t.Error("an explicit continue_on_error: false was not kept")
+	}
+}
+
+func TestEmptyResponseRemovesUnansweredMessage(t *testing.T) {
+	for _, mode := range []string{"warn", "retry"} {
+		t.Run(mode, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, "data: [DONE]\n\n")
+			}))
+			defer server.Close()
+
+			client := newTestClient(t, server.URL, "empty_response: "+mode+"\n")
+			var out strings.Builder
+			session := &ChatSession{apiClient: client, conversation: &Conversation{}, out: &out}
+			session.conversation.addMessage("user", "earlier")
+			session.conversation.addMessage("assistant", "reply")
+
+			if err := sendUserInput(context.Background(), session, "question"); err != nil {
+				t.Fatal(err)
+			}
+			history := session.conversation.getHistory()
+			if last := history[len(history)-1]; last.Role != "assistant" || last.Content != "reply" {
+				t.Errorf("history ends with %s %q, want the earlier reply", last.Role, last.Content)
+			}
+			want := int32(1)
+			if mode == "retry" {
+				want = 2
+			}
+			if got := requests.Load(); got != want {
+				t.Errorf("sent %d requests, want %d", got, want)
+			}
+			if !strings.Contains(out.String(), "empty response") {
+				t.Errorf("output %q does not report the empty response", out.String())
+			}
+		})
+	}
+}
+
+func TestDetectLoop(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"repeated sentence", "Intro. " + strings.Repeat("I will repeat this. ", 5), true},
+		{"normal prose", "The quick brown fox jumps over the lazy dog while the cat watches.", false},
+		{"markdown rule", "Heading\n" + strings.Repeat("-", 200), false},
+		{"table separator", "| a | b |\n" + strings.Repeat("=", 120), false},
+		{"blank lines", "text" + strings.Repeat("\n", 100), false},
+		{"repeated multibyte sentence", "前置き。" + strings.Repeat("同じ文を繰り返します。", 4), true},
+		{"multibyte prose", "日本語の文章はここで終わりますが、繰り返しはありません。", false},
+		{"single multibyte rune", "見出し" + strings.Repeat("─", 100), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLoop(tt.text, 3); got != tt.want {
+				t.Errorf("detectLoop(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemPromptResolvedNextToConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, systemPromptFile), []byte("config dir prompt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	data := fmt.Sprintf("groq_api_key: gsk_%s\nsessions_dir: %s\n", strings.Repeat("x", 32), t.TempDir())
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	conversation, err := newConversation(config.systemPromptPath)
+	if err != nil {
+		t.Fatalf("newConversation: %v", err)
+	}
+	if got := conversation.getHistory()[0].Content; got != "config dir prompt" {
+		t.Errorf("system prompt = %q, want the one next to the config file", got)
+	}
+
+	os.Remove(filepath.Join(dir, systemPromptFile))
+	if config, err = loadConfig(path, ""); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.systemPromptPath != systemPromptFile {
+		t.Errorf("systemPromptPath = %q, want the working directory fallback %q", config.systemPromptPath, systemPromptFile)
+	}
+}
+
+func TestRedactedConfigHidesSecrets(t *testing.T) {
+	client := newTestClient(t, apiBaseURL, "extra_headers:\n  X-Api-Token: secret-token-value\n")
+	config := redactedConfig(client.config)
+
+	if strings.Contains(config.GroqAPIKey, strings.Repeat("x", 32)) {
+		t.Errorf("api key was not redacted: %q", config.GroqAPIKey)
+	}
+	if got := config.ExtraHeaders["X-Api-Token"]; strings.Contains(got, "secret-token") {
+		t.Errorf("extra header was not redacted: %q", got)
+	}
+	if got := client.config.ExtraHeaders["X-Api-Token"]; got != "secret-token-value" {
+		t.Errorf("redacting modified the live config: %q", got)
+	}
+}
+
+func TestRunBatchSendsEachRecordSeparately(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseEvents(fmt.Sprintf("answer%d", n)))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "stream_delay_millis: 0\n")
+	store, err := newConversationStore(client.config, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	session := &ChatSession{apiClient: client, conversation: &Conversation{}, out: &out, quiet: true, store: store}
+
+	if err := runBatch(context.Background(), session, strings.NewReader("q1\n\nq2"), client.config.BatchDelimiter); err != nil {
+		t.Fatalf("runBatch: %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+	if !strings.Contains(out.String(), batchSeparator) {
+		t.Errorf("output %q has no separator between answers", out.String())
+	}
+}
+
+func TestStreamStallTimeoutIgnoresKeepAlives(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			io.WriteString(w, ": ping\n\ndata: {\"choices\":[{\"delta\":{}}]}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "stream_stall_timeout: 150ms\n")
+	done := make(chan error, 1)
+	go func() {
+		_, err := getAIResponse(context.Background(), client, testConversation(), client.model, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errStreamStalled) {
+			t.Fatalf("expected errStreamStalled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stream of keep-alives never stalled")
+	}
+}
+
+func TestLoopDetectedWithoutTerminalRemovesUnansweredMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseEvents(strings.Repeat("I will repeat this. ", 10)))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, "loop_repeat_threshold: 3\n")
+	session := &ChatSession{apiClient: client, conversation: &Conversation{}, out: io.Discard}
+	session.conversation.addMessage("user", "earlier")
+	session.conversation.addMessage("assistant", "reply")
+
+	if err := sendUserInput(context.Background(), session, "question"); err != nil {
+		t.Fatal(err)
+	}
+	history := session.conversation.getHistory()
+	if last := history[len(history)-1]; last.Role != "assistant" || last.Content != "reply" {
+		t.Errorf("history ends with %s %q, want the earlier reply", last.Role, last.Content)
+	}
+}
+
+func TestConversationChangesMarkDirty(t *testing.T) {
+	newSaved := func() *Conversation {
+		conversation := &Conversation{}
+		conversation.addMessage("system", "prompt")
+		conversation.addMessage("user", "one")
+		conversation.addMessage("user", "two")
+		conversation.markSaved()
+		return conversation
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Conversation)
+	}{
+		{"clear", func(c *Conversation) { c.clear() }},
+		{"merge adjacent roles", func(c *Conversation) { c.mergeAdjacentRoles() }},
+		{"replace", func(c *Conversation) { c.replaceWith(newSaved()) }},
+		{"pin", func(c *Conversation) { c.setPinned(1, true) }},
+		{"title", func(c *Conversation) { c.setTitle("renamed") }},
+		{"attach images", func(c *Conversation) { c.attachImages([]string{"https://example.com/a.png"}) }},
+		{"remove unanswered message", func(c *Conversation) { c.removeTrailingUserMessage() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conversation := newSaved()
+			tt.change(conversation)
+			if !conversation.isDirty() {
+				t.Error("change did not mark the conversation dirty")
+			}
+		})
+	}
+}
+
+func TestConfigExpandsEnvironmentVariables(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AICHAT_TEST_HOST", "http://127.0.0.1:9")
+	t.Setenv("AICHAT_TEST_DIR", dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("gsk_"+strings.Repeat("x", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	data := "api_key_file: ${AICHAT_TEST_DIR}/key\nbase_url: ${AICHAT_TEST_HOST}/v1\nsqlite_path: ${AICHAT_TEST_DIR}/chat.db\nsessions_dir: " + dir + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.BaseURL != "http://127.0.0.1:9/v1" {
+		t.Errorf("base_url = %q", config.BaseURL)
+	}
+	if config.SQLitePath != filepath.Join(dir, "chat.db") {
+		t.Errorf("sqlite_path = %q", config.SQLitePath)
+	}
+	if config.GroqAPIKey == "" {
+		t.Error("api_key_file was not read from the expanded path")
+	}
+}
+
+func TestSnapshotKeepsTruncationSettings(t *testing.T) {
+	conversation := &Conversation{keepFullHistory: true, maxHistoryMessages: 7, maxTokens: 100}
+	snapshot := conversation.snapshot()
+	if !snapshot.keepFullHistory || snapshot.maxHistoryMessages != 7 || snapshot.maxTokens != 100 {
+		t.Errorf("snapshot lost truncation settings: keepFullHistory %v, maxHistoryMessages %d, maxTokens %d",
+			snapshot.keepFullHistory, snapshot.maxHistoryMessages, snapshot.maxTokens)
+	}
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "conversations.db"), io.Discard)
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	conversation := &Conversation{}
+	conversation.addMessage("system", "prompt")
+	conversation.addMessage("user", "hello")
+	conversation.addMessage("assistant", "hi there")
+	conversation.setTitle("greeting")
+	conversation.setPinned(1, true)
+	conversation.attachImages([]string{"https://example.com/a.png"})
+
+	if err := store.Save("first", conversation); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	conversation.addMessage("user", "again")
+	if err := store.Save("first", conversation); err != nil {
+		t.Fatalf("Save over an existing name: %v", err)
+	}
+	if err := store.Save("second", testConversation()); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := store.Load("first")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.getTitle() != "greeting" {
+		t.Errorf("title = %q, want %q", loaded.getTitle(), "greeting")
+	}
+	want, got := conversation.getHistory(), loaded.getHistory()
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Role != want[i].Role || got[i].Content != want[i].Content || got[i].Pinned != want[i].Pinned || len(got[i].Images) != len(want[i].Images) {
+			t.Errorf("message %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := store.Load("missing"); err == nil {
+		t.Error("Load of an unknown name succeeded")
+	}
+
+	stored, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(stored) != 2 || stored[0].Name != "first" || stored[0].Detail != "4 messages" || stored[1].Name != "second" {
+		t.Errorf("List = %+v", stored)
+	}
+}
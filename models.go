@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const modelsCacheTTL = 5 * time.Minute
+
+type ModelInfo struct {
+	ID            string `json:"id"`
+	ContextWindow int    `json:"context_window"`
+}
+
+type modelsCache struct {
+	mu        sync.Mutex
+	models    []ModelInfo
+	fetchedAt time.Time
+}
+
+func (c *APIClient) listModels(ctx context.Context) ([]ModelInfo, error) {
+	c.modelsCache.mu.Lock()
+	defer c.modelsCache.mu.Unlock()
+
+	if c.modelsCache.models != nil && time.Since(c.modelsCache.fetchedAt) < modelsCacheTTL {
+		return c.modelsCache.models, nil
+	}
+
+	models, err := c.fetchModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.modelsCache.models = models
+	c.modelsCache.fetchedAt = time.Now()
+	return models, nil
+}
+
+func (c *modelsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.models = nil
+}
+
+func (c *APIClient) fetchModels(ctx context.Context) ([]ModelInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*timeoutSeconds)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.setCommonHeaders(req)
+
+	response, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("authentication failed with status %d, check your API key", response.StatusCode)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("models request failed with status %d: %s", response.StatusCode, string(body))
+	}
+
+	var payload struct {
+		Data []ModelInfo `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse models response: %w", err)
+	}
+
+	sort.Slice(payload.Data, func(i, j int) bool {
+		return payload.Data[i].ID < payload.Data[j].ID
+	})
+	return payload.Data, nil
+}
+
+func checkConnection(ctx context.Context, apiClient *APIClient) error {
+	models, err := apiClient.listModels(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sAPI key OK, %d models available.%s\n", colorGreen, len(models), colorReset)
+	return nil
+}
+
+func handleModelsCommand(ctx context.Context, session *ChatSession) error {
+	apiClient := session.apiClient
+	models, err := apiClient.listModels(ctx)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError listing models: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+
+	fmt.Fprintf(session.out, "%sAvailable models:%s\n", colorCyan, colorReset)
+	for _, model := range models {
+		marker := " "
+		if model.ID == apiClient.model {
+			marker = "*"
+		}
+		if model.ContextWindow > 0 {
+			fmt.Fprintf(session.out, "%s %s (context window %d)\n", marker, model.ID, model.ContextWindow)
+		} else {
+			fmt.Fprintf(session.out, "%s %s\n", marker, model.ID)
+		}
+	}
+	return nil
+}
+
+func pickModel(ctx context.Context, apiClient *APIClient, input *LineReader) {
+	models, err := apiClient.listModels(ctx)
+	if err != nil || len(models) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no models available")
+		}
+		fmt.Printf("%sCould not fetch models (%v), using %s.%s\n", colorYellow, err, apiClient.model, colorReset)
+		return
+	}
+
+	fmt.Printf("%sAvailable models:%s\n", colorCyan, colorReset)
+	for i, model := range models {
+		fmt.Printf("%3d. %s\n", i+1, model.ID)
+	}
+
+	for {
+		fmt.Printf("%sSelect a model [1-%d] (Enter for %s):%s ", colorGreen, len(models), apiClient.model, colorReset)
+		choice, err := input.readLine(ctx, 0)
+		if err != nil || choice == "" {
+			return
+		}
+
+		index, err := strconv.Atoi(choice)
+		if err != nil || index < 1 || index > len(models) {
+			fmt.Printf("%sInvalid selection.%s\n", colorRed, colorReset)
+			continue
+		}
+
+		apiClient.model = models[index-1].ID
+		return
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+type CoalescingWriter struct {
+	out       *bufio.Writer
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func newCoalescingWriter(w io.Writer, interval time.Duration) *CoalescingWriter {
+	return &CoalescingWriter{
+		out:       bufio.NewWriter(w),
+		interval:  interval,
+		lastFlush: time.Now(),
+	}
+}
+
+func (w *CoalescingWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if w.interval <= 0 || time.Since(w.lastFlush) >= w.interval {
+		return n, w.Flush()
+	}
+	return n, nil
+}
+
+func (w *CoalescingWriter) Flush() error {
+	w.lastFlush = time.Now()
+	return w.out.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+func handleQueueCommand(session *ChatSession) error {
+	if session.queueing {
+		fmt.Fprintf(session.out, "%sAlready queueing (%d pending). Type /run to send.%s\n", colorYellow, len(session.queue), colorReset)
+		return nil
+	}
+	session.queueing = true
+	fmt.Fprintf(session.out, "%sQueue mode: messages are queued until /run.%s\n", colorGreen, colorReset)
+	return nil
+}
+
+func handleRunCommand(ctx context.Context, session *ChatSession) error {
+	session.queueing = false
+	queue := session.queue
+	session.queue = nil
+	if len(queue) == 0 {
+		fmt.Fprintf(session.out, "%sThe queue is empty.%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	for i, prompt := range queue {
+		if ctx.Err() != nil {
+			return nil
+		}
+		fmt.Fprintf(session.out, "%s[%d/%d] %s%s\n", colorDim, i+1, len(queue), truncateString(prompt, 60), colorReset)
+		if err := sendUserInput(ctx, session, prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleShowQueueCommand(session *ChatSession) error {
+	if len(session.queue) == 0 {
+		fmt.Fprintf(session.out, "%sThe queue is empty.%s\n", colorYellow, colorReset)
+		return nil
+	}
+	fmt.Fprintf(session.out, "%sQueued messages:%s\n", colorCyan, colorReset)
+	for i, prompt := range session.queue {
+		fmt.Fprintf(session.out, "%3d. %s\n", i+1, truncateString(prompt, 70))
+	}
+	return nil
+}
+
+func handleClearQueueCommand(session *ChatSession) error {
+	fmt.Fprintf(session.out, "%sDiscarded %d queued message(s).%s\n", colorYellow, len(session.queue), colorReset)
+	session.queue = nil
+	session.queueing = false
+	return nil
+}
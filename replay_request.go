@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+func replayRequest(ctx context.Context, apiClient *APIClient, path string, out io.Writer) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read request file: %w", err)
+	}
+	if err := validateRequestBody(body); err != nil {
+		return fmt.Errorf("invalid request body in %s: %w", path, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiClient.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	requestID := newRequestID()
+	req.Header.Set("Content-Type", "application/json")
+	if apiClient.config.RequestIDHeader != "" {
+		req.Header.Set(apiClient.config.RequestIDHeader, requestID)
+	}
+	apiClient.setCommonHeaders(req)
+
+	response, err := apiClient.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request %s: %w", requestID, err)
+	}
+	defer response.Body.Close()
+
+	fmt.Fprintf(out, "%s (%s)\n\n", response.Status, describeRequestIDs(requestID, response.Header.Get("X-Request-Id")))
+	if _, err := io.Copy(out, response.Body); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	fmt.Fprintln(out)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("replayed request failed with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func validateRequestBody(body []byte) error {
+	var request struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role string `json:"role"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return fmt.Errorf("not a JSON request object: %w", err)
+	}
+	if request.Model == "" {
+		return errors.New("missing model")
+	}
+	if len(request.Messages) == 0 {
+		return errors.New("missing messages")
+	}
+	for i, msg := range request.Messages {
+		if msg.Role == "" {
+			return fmt.Errorf("message %d has no role", i+1)
+		}
+	}
+	return nil
+}
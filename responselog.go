@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const maxResponseLogSize = 50 * 1024 * 1024
+
+type ResponseLogger struct {
+	path   string
+	apiKey string
+}
+
+type responseRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Model      string    `json:"model"`
+	Prompt     string    `json:"prompt"`
+	Response   string    `json:"response"`
+	Usage      *Usage    `json:"usage,omitempty"`
+	LatencyMS  int64     `json:"latency_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ProviderID string    `json:"provider_request_id,omitempty"`
+}
+
+func newResponseLogger(path, apiKey string) *ResponseLogger {
+	return &ResponseLogger{path: path, apiKey: apiKey}
+}
+
+func (l *ResponseLogger) log(prompt string, response AIResponse, latency time.Duration) error {
+	record := responseRecord{
+		Timestamp:  time.Now(),
+		Model:      response.Model,
+		Prompt:     l.redact(prompt),
+		Response:   l.redact(response.Content),
+		Usage:      response.Usage,
+		LatencyMS:  latency.Milliseconds(),
+		RequestID:  response.RequestID,
+		ProviderID: response.ProviderID,
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	if err := l.rotate(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", l.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %w", l.path, err)
+	}
+	return file.Sync()
+}
+
+func (l *ResponseLogger) rotate() error {
+	info, err := os.Stat(l.path)
+	if err != nil || info.Size() < maxResponseLogSize {
+		return nil
+	}
+
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", l.path, err)
+	}
+	return nil
+}
+
+func (l *ResponseLogger) redact(text string) string {
+	if l.apiKey == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, l.apiKey, redactAPIKey(l.apiKey))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spinnerInterval = 100 * time.Millisecond
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+type Spinner struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+type streamStats struct {
+	mu         sync.Mutex
+	start      time.Time
+	firstToken time.Time
+	tokens     int
+}
+
+func (s *streamStats) add(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firstToken.IsZero() {
+		s.firstToken = time.Now()
+	}
+	s.tokens += len(strings.Fields(text))
+}
+
+func (s *streamStats) status(waiting string) func() string {
+	return func() string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.firstToken.IsZero() {
+			return fmt.Sprintf("%s %.1fs", waiting, time.Since(s.start).Seconds())
+		}
+		rate := 0.0
+		if streaming := time.Since(s.firstToken).Seconds(); streaming > 0 {
+			rate = float64(s.tokens) / streaming
+		}
+		return fmt.Sprintf("%.1fs, %d tokens, %.1f tok/s", time.Since(s.start).Seconds(), s.tokens, rate)
+	}
+}
+
+func startSpinner(session *ChatSession, message string) *Spinner {
+	return startStatusLine(session, func() string { return message })
+}
+
+func startStatusLine(session *ChatSession, status func() string) *Spinner {
+	if session.quiet || !session.terminal.SupportsANSI {
+		return nil
+	}
+
+	spinner := &Spinner{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(spinner.done)
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+
+		for frame := 0; ; frame++ {
+			fmt.Fprintf(session.out, "\r\033[K%s%s %s%s", colorDim, spinnerFrames[frame%len(spinnerFrames)], status(), colorReset)
+			select {
+			case <-spinner.stop:
+				fmt.Fprint(session.out, "\r\033[K")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return spinner
+}
+
+func (s *Spinner) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type ConversationStore interface {
+	Save(name string, conversation *Conversation) error
+	Load(name string) (*Conversation, error)
+	List() ([]StoredConversation, error)
+	Location() string
+	Close() error
+}
+
+type StoredConversation struct {
+	Name    string
+	SavedAt time.Time
+	Detail  string
+}
+
+func newConversationStore(config *Config, out io.Writer) (ConversationStore, error) {
+	switch config.Storage {
+	case "sqlite":
+		return newSQLiteStore(config.SQLitePath, out)
+	default:
+		return &JSONFileStore{dir: config.SessionsDir, out: out}, nil
+	}
+}
+
+func defaultConversationName() string {
+	return fmt.Sprintf("conversation_%s", time.Now().Format("20060102_150405"))
+}
+
+type JSONFileStore struct {
+	dir string
+	out io.Writer
+}
+
+func (s *JSONFileStore) Save(name string, conversation *Conversation) error {
+	if name == "" {
+		name = defaultConversationName()
+	}
+	if filepath.Ext(name) == "" {
+		name += ".json"
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(s.dir, name)
+	}
+	return saveConversationAs(s.out, conversation, name)
+}
+
+func (s *JSONFileStore) Load(name string) (*Conversation, error) {
+	path := resolveSessionPath(name, s.dir)
+	if _, err := os.Stat(path); err != nil && filepath.Ext(name) == "" {
+		path = resolveSessionPath(name+".json", s.dir)
+	}
+	return loadConversation(path)
+}
+
+func (s *JSONFileStore) List() ([]StoredConversation, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions directory: %w", err)
+	}
+	sort.Strings(matches)
+
+	var stored []StoredConversation
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		stored = append(stored, StoredConversation{
+			Name:    filepath.Base(match),
+			SavedAt: info.ModTime(),
+			Detail:  fmt.Sprintf("%d bytes", info.Size()),
+		})
+	}
+	return stored, nil
+}
+
+func (s *JSONFileStore) Location() string {
+	return s.dir
+}
+
+func (s *JSONFileStore) Close() error {
+	return nil
+}
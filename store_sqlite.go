@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id       INTEGER PRIMARY KEY,
+	name     TEXT NOT NULL UNIQUE,
+	title    TEXT NOT NULL DEFAULT '',
+	saved_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+	position        INTEGER NOT NULL,
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	pinned          INTEGER NOT NULL DEFAULT 0,
+	images          TEXT,
+	created_at      TIMESTAMP NOT NULL,
+	PRIMARY KEY (conversation_id, position)
+);
+CREATE INDEX IF NOT EXISTS messages_role ON messages (role);
+CREATE INDEX IF NOT EXISTS messages_created_at ON messages (created_at);
+`
+
+type SQLiteStore struct {
+	db   *sql.DB
+	path string
+	out  io.Writer
+}
+
+func newSQLiteStore(path string, out io.Writer) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	return &SQLiteStore{db: db, path: path, out: out}, nil
+}
+
+func (s *SQLiteStore) Save(name string, conversation *Conversation) error {
+	if name == "" {
+		name = defaultConversationName()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`INSERT INTO conversations (name, title, saved_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET title = excluded.title, saved_at = excluded.saved_at RETURNING id`,
+		name, conversation.getTitle(), time.Now()).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to replace messages: %w", err)
+	}
+
+	for position, msg := range conversation.getHistory() {
+		var images []byte
+		if len(msg.Images) > 0 {
+			if images, err = json.Marshal(msg.Images); err != nil {
+				return fmt.Errorf("failed to marshal images: %w", err)
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO messages (conversation_id, position, role, content, pinned, images, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, id, position, msg.Role, msg.Content, msg.Pinned, images, msg.Timestamp)
+		if err != nil {
+			return fmt.Errorf("failed to save message: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit conversation: %w", err)
+	}
+
+	fmt.Fprintf(s.out, "%sConversation saved as %q in %s%s\n", colorGreen, name, s.path, colorReset)
+	return nil
+}
+
+func (s *SQLiteStore) Load(name string) (*Conversation, error) {
+	var id int64
+	var title string
+	err := s.db.QueryRow(`SELECT id, title FROM conversations WHERE name = ?`, name).Scan(&id, &title)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no saved conversation named %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up conversation: %w", err)
+	}
+
+	rows, err := s.db.Query(`SELECT role, content, pinned, images, created_at FROM messages
+		WHERE conversation_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load messages: %w", err)
+	}
+	defer rows.Close()
+
+	var history []Message
+	for rows.Next() {
+		var msg Message
+		var images sql.NullString
+		if err := rows.Scan(&msg.Role, &msg.Content, &msg.Pinned, &images, &msg.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to read message: %w", err)
+		}
+		if images.Valid {
+			if err := json.Unmarshal([]byte(images.String), &msg.Images); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal images: %w", err)
+			}
+		}
+		history = append(history, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	return &Conversation{Title: title, History: history, tokenCount: countTokens(history)}, nil
+}
+
+func (s *SQLiteStore) List() ([]StoredConversation, error) {
+	rows, err := s.db.Query(`SELECT c.name, c.saved_at, COUNT(m.position) FROM conversations c
+		LEFT JOIN messages m ON m.conversation_id = c.id GROUP BY c.id ORDER BY c.saved_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+	defer rows.Close()
+
+	var stored []StoredConversation
+	for rows.Next() {
+		var entry StoredConversation
+		var messages int
+		if err := rows.Scan(&entry.Name, &entry.SavedAt, &messages); err != nil {
+			return nil, fmt.Errorf("failed to read conversation: %w", err)
+		}
+		entry.Detail = fmt.Sprintf("%d messages", messages)
+		stored = append(stored, entry)
+	}
+	return stored, rows.Err()
+}
+
+func (s *SQLiteStore) Location() string {
+	return s.path
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ConversationTemplate struct {
+	System   string `yaml:"system"`
+	Messages []struct {
+		Role    string `yaml:"role"`
+		Content string `yaml:"content"`
+	} `yaml:"messages"`
+}
+
+func listTemplates(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ext))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func loadTemplate(dir, name, systemPromptPath string) (*Conversation, error) {
+	if name != filepath.Base(name) {
+		return nil, fmt.Errorf("invalid template name %q", name)
+	}
+
+	var data []byte
+	var err error
+	for _, ext := range []string{".yaml", ".yml"} {
+		data, err = os.ReadFile(filepath.Join(dir, name+ext))
+		if !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("template %q not found in %s", name, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+
+	var template ConversationTemplate
+	if err := yaml.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse template %q: %w", name, err)
+	}
+
+	system := expandEnv(template.System)
+	if strings.TrimSpace(system) == "" {
+		if system, err = loadSystemPrompt(systemPromptPath); err != nil {
+			return nil, fmt.Errorf("failed to load system prompt: %w", err)
+		}
+	}
+
+	now := time.Now()
+	history := []Message{{Role: "system", Content: system, Timestamp: now}}
+	for i, msg := range template.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("template %q message %d has role %q, expected user or assistant", name, i+1, msg.Role)
+		}
+		history = append(history, Message{Role: msg.Role, Content: expandEnv(msg.Content), Timestamp: now})
+	}
+	return &Conversation{Title: name, History: history, tokenCount: countTokens(history)}, nil
+}
+
+func handleTemplateCommand(userInput string, session *ChatSession) error {
+	dir := session.apiClient.config.TemplatesDir
+	name := strings.TrimSpace(strings.TrimPrefix(userInput, "/template"))
+	if name == "" {
+		names, err := listTemplates(dir)
+		if err != nil {
+			fmt.Fprintf(session.out, "%sError listing templates: %v%s\n", colorRed, err, colorReset)
+			return nil
+		}
+		if len(names) == 0 {
+			fmt.Fprintf(session.out, "%sNo templates in %s.%s\n", colorYellow, dir, colorReset)
+			return nil
+		}
+		fmt.Fprintf(session.out, "%sTemplates in %s:%s\n", colorCyan, dir, colorReset)
+		for _, name := range names {
+			fmt.Fprintf(session.out, "  %s\n", name)
+		}
+		return nil
+	}
+
+	template, err := loadTemplate(dir, name, session.apiClient.config.systemPromptPath)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError loading template: %v%s\n", colorRed, err, colorReset)
+		return nil
+	}
+	session.conversation.replaceWith(template)
+	session.conversation.markSaved()
+	fmt.Fprintf(session.out, "%sStarted a new conversation from template %q.%s\n", colorGreen, name, colorReset)
+	printConversationSummary(session.out, session.conversation, session.apiClient.config)
+	return nil
+}
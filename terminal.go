@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const defaultTerminalWidth = 80
+
+type Terminal struct {
+	IsTTY         bool
+	Width         int
+	SupportsANSI  bool
+	SupportsColor bool
+	Interactive   bool
+}
+
+func detectTerminal() Terminal {
+	fd := int(os.Stdout.Fd())
+	terminal := Terminal{
+		IsTTY:       term.IsTerminal(fd),
+		Width:       defaultTerminalWidth,
+		Interactive: term.IsTerminal(int(os.Stdin.Fd())),
+	}
+
+	if terminal.IsTTY {
+		if width, _, err := term.GetSize(fd); err == nil && width > 0 {
+			terminal.Width = width
+		}
+	}
+
+	terminal.SupportsANSI = terminal.IsTTY && enableVirtualTerminal(fd)
+	terminal.SupportsColor = terminal.SupportsANSI && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	return terminal
+}
+
+var (
+	colorReset  = "\033[0m"
+	colorDim    = "\033[2m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorBlue   = "\033[34m"
+	colorPurple = "\033[35m"
+	colorCyan   = "\033[36m"
+)
+
+func disableColors() {
+	colorReset, colorDim, colorRed, colorGreen = "", "", "", ""
+	colorYellow, colorBlue, colorPurple, colorCyan = "", "", "", ""
+}
+
+func escapeSequenceLength(s string) int {
+	if len(s) < 2 || s[0] != '\033' || s[1] != '[' {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] >= 0x40 && s[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+func visibleLength(s string) int {
+	length := 0
+	for i := 0; i < len(s); {
+		if n := escapeSequenceLength(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		length++
+	}
+	return length
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package main
+
+func enableVirtualTerminal(fd int) bool {
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	urlFetchTimeout  = 15 * time.Second
+	maxURLFetchBytes = 4 * 1024 * 1024
+)
+
+var (
+	htmlHiddenPattern  = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head)\b.*?</(script|style|noscript|svg|head)>`)
+	htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlBlockPattern   = regexp.MustCompile(`(?i)</?(p|div|br|li|ul|ol|tr|h[1-6]|pre|blockquote|section|article|table|hr)\b[^>]*>`)
+	htmlTagPattern     = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern  = regexp.MustCompile(`\n{3,}`)
+)
+
+func handleURLCommand(ctx context.Context, userInput string, session *ChatSession) error {
+	link := strings.TrimSpace(strings.TrimPrefix(userInput, "/url"))
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		fmt.Fprintf(session.out, "%sUsage: /url <http(s) link>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	text, err := fetchURLText(ctx, session.apiClient, link)
+	if err != nil {
+		fmt.Fprintf(session.out, "%sError fetching %s: %v%s\n", colorRed, link, err, colorReset)
+		return nil
+	}
+
+	budget := session.apiClient.config.ContextBudgetBytes
+	truncated := len(text) > budget
+	if truncated {
+		text = truncateBytes(text, budget)
+	}
+
+	session.pendingPages = append(session.pendingPages, fmt.Sprintf("Content of %s:\n```\n%s\n```", link, text))
+
+	fmt.Fprintf(session.out, "%sLoaded %d bytes from %s into your next message.%s\n", colorGreen, len(text), link, colorReset)
+	if truncated {
+		fmt.Fprintf(session.out, "%sThe page was cut to the context budget of %d bytes.%s\n", colorYellow, budget, colorReset)
+	}
+	return nil
+}
+
+func fetchURLText(ctx context.Context, apiClient *APIClient, link string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, urlFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", apiClient.config.UserAgent)
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9")
+
+	client := &http.Client{Transport: apiClient.httpClient.Transport, Timeout: urlFetchTimeout}
+	response, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request failed with status %d", response.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" && mediaType != "text/plain" {
+		return "", fmt.Errorf("unsupported content type %q, only HTML and plain text pages can be loaded", mediaType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxURLFetchBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if !utf8.Valid(data) {
+		data = []byte(strings.ToValidUTF8(string(data), "\uFFFD"))
+	}
+
+	if mediaType == "text/plain" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	return extractHTMLText(string(data)), nil
+}
+
+func extractHTMLText(page string) string {
+	page = htmlCommentPattern.ReplaceAllString(page, "")
+	page = htmlHiddenPattern.ReplaceAllString(page, "")
+	page = htmlBlockPattern.ReplaceAllString(page, "\n")
+	page = html.UnescapeString(htmlTagPattern.ReplaceAllString(page, ""))
+
+	lines := strings.Split(page, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+func truncateBytes(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	s = s[:limit]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const withCommandTimeout = 30 * time.Second
+
+func handleWithCommand(ctx context.Context, userInput string, session *ChatSession) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(userInput, "/with"))
+	if arg == "" {
+		fmt.Fprintf(session.out, "%sUsage: /with <text> or /with !<shell command>%s\n", colorYellow, colorReset)
+		return nil
+	}
+
+	note := arg
+	if command, ok := strings.CutPrefix(arg, "!"); ok {
+		if !session.apiClient.config.AllowShellCommands {
+			fmt.Fprintf(session.out, "%sShell commands are disabled; set allow_shell_commands: true to enable them.%s\n", colorRed, colorReset)
+			return nil
+		}
+		output, err := runShellCommand(ctx, command)
+		if err != nil {
+			fmt.Fprintf(session.out, "%sError running %q: %v%s\n", colorRed, command, err, colorReset)
+			return nil
+		}
+		note = fmt.Sprintf("Output of `%s`:\n```\n%s\n```", command, output)
+	}
+
+	if budget := session.apiClient.config.ContextBudgetBytes; len(note) > budget {
+		note = truncateBytes(note, budget)
+		fmt.Fprintf(session.out, "%sThe context was cut to the context budget of %d bytes.%s\n", colorYellow, budget, colorReset)
+	}
+
+	session.pendingContext = append(session.pendingContext, note)
+	fmt.Fprintf(session.out, "%sContext (%d bytes) will be sent with your next message only.%s\n", colorGreen, len(note), colorReset)
+	return nil
+}
+
+func runShellCommand(ctx context.Context, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, withCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+func withEphemeralContext(history []Message, notes []string) []Message {
+	if len(notes) == 0 || len(history) == 0 || history[len(history)-1].Role != "user" {
+		return history
+	}
+
+	last := len(history) - 1
+	withNotes := append([]Message(nil), history[:last]...)
+	for _, note := range notes {
+		withNotes = append(withNotes, Message{Role: "system", Content: note})
+	}
+	return append(withNotes, history[last])
+}